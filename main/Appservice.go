@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//appService is nil if the bridge runs as normal bot
+var appService *appservice.AppService
+
+//display names already set for the puppets since the start
+var puppetNames = make(map[id.UserID]string)
+var puppetMutex sync.Mutex
+
+//initAppservice loads the registration of the appservice mode and starts the listener for the homeserver.
+//If there is no registration file yet, it gets generated and true is returned, because the homeserver has to load it first
+func initAppservice() (bool, error) {
+	localpart, domain, err := id.UserID(viper.GetString("matrixuserid")).Parse()
+	if err != nil {
+		return false, errors.New("invalid matrixuserid: " + err.Error())
+	}
+
+	registrationFile := viper.GetString("appservice.registration")
+	registration, err := appservice.LoadRegistration(registrationFile)
+	if os.IsNotExist(err) {
+		registration = appservice.CreateRegistration()
+		registration.ID = "emailbridge"
+		registration.URL = viper.GetString("appservice.url")
+		registration.SenderLocalpart = localpart
+		rateLimited := false
+		registration.RateLimited = &rateLimited
+		puppetRegex := regexp.MustCompile("@" + regexp.QuoteMeta(viper.GetString("appservice.userprefix")) + ".*:" + regexp.QuoteMeta(domain))
+		registration.Namespaces.RegisterUserIDs(puppetRegex, true)
+		if err = registration.Save(registrationFile); err != nil {
+			return false, err
+		}
+		fmt.Println("Created the appservice registration " + registrationFile + ". Add it to app_service_config_files of your homeserver, restart the homeserver and start the bridge again")
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	as := appservice.Create()
+	as.HomeserverURL = viper.GetString("matrixserver")
+	as.HomeserverDomain = domain
+	as.Host.Hostname = viper.GetString("appservice.hostname")
+	as.Host.Port = uint16(viper.GetUint("appservice.port"))
+	as.LogConfig.Directory = dirPrefix + logDir
+	as.LogConfig.FileNameFormat = "appservice_%[1]s-%02[2]d.log"
+	as.LogConfig.PrintLevel = 50
+	if _, err = as.Init(); err != nil {
+		return false, err
+	}
+	as.Registration = registration
+
+	//as.Start only logs listener errors to its own log, so a taken port gets reported here
+	listener, err := net.Listen("tcp", as.Host.Address())
+	if err != nil {
+		return false, err
+	}
+	listener.Close()
+	go func() {
+		as.Start()
+		//the listener is never stopped, so returning means it failed
+		WriteLog(critical, "#151 appservice listener on "+as.Host.Address()+" stopped, see the appservice log")
+		fmt.Println("The appservice listener stopped, see the appservice log")
+		os.Exit(1)
+	}()
+	//events are received by the sync of the bot, the ones pushed by the homeserver aren't needed
+	go func() {
+		for range as.Events {
+		}
+	}()
+	appService = as
+	return false, nil
+}
+
+//puppetUserID returns the matrix user representing an email address
+func puppetUserID(address string) id.UserID {
+	localpart := viper.GetString("appservice.userprefix") + id.EncodeUserLocalpart(strings.ToLower(address))
+	return id.NewUserID(localpart, appService.HomeserverDomain)
+}
+
+//isPuppet returns true if the user is the puppet of an email sender
+func isPuppet(userID id.UserID) bool {
+	if appService == nil {
+		return false
+	}
+	localpart, domain, err := userID.Parse()
+	return err == nil && domain == appService.HomeserverDomain && strings.HasPrefix(localpart, viper.GetString("appservice.userprefix"))
+}
+
+//getPuppet returns the user an email of the sender gets posted as. nil means the bot has to post it,
+//which is the case without appservice mode and in encrypted rooms, because puppets have no encryption keys
+func getPuppet(roomID id.RoomID, address, name string) *appservice.IntentAPI {
+	if appService == nil || len(address) == 0 || store.IsEncrypted(roomID) {
+		return nil
+	}
+	puppet := appService.Intent(puppetUserID(address))
+	if err := puppet.EnsureJoined(roomID); err != nil {
+		WriteLog(logError, "#121 puppet "+puppet.UserID.String()+" can't join: "+err.Error())
+		return nil
+	}
+
+	if len(name) == 0 {
+		name = address
+	}
+	puppetMutex.Lock()
+	defer puppetMutex.Unlock()
+	if puppetNames[puppet.UserID] != name {
+		if err := puppet.SetDisplayName(name); err != nil {
+			WriteLog(logError, "#122 setting puppet displayname: "+err.Error())
+		} else {
+			puppetNames[puppet.UserID] = name
+		}
+	}
+	return puppet
+}
+
+//sendMessageEventAs sends an event as the puppet or as the bot if puppet is nil
+func sendMessageEventAs(puppet *appservice.IntentAPI, roomID id.RoomID, eventType event.Type, content interface{}) (*mautrix.RespSendEvent, error) {
+	if puppet == nil {
+		return sendMessageEvent(roomID, eventType, content)
+	}
+	return puppet.SendMessageEvent(roomID, eventType, content)
+}
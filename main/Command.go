@@ -1,14 +1,13 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
+	"html"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/gomarkdown/markdown"
 	"github.com/spf13/viper"
 	"gopkg.in/gomail.v2"
 	"maunium.net/go/mautrix/event"
@@ -18,69 +17,127 @@ import (
 type CommandHandler func(evt *event.Event, message string)
 
 var commands = map[string]CommandHandler{
-	"!help":       help,
-	"!login":      login,
-	"!logout":     logout,
-	"!setup":      setup,
-	"!write":      write,
-	"!ping":       ping,
-	"!setmailbox": setMailbox,
-	"!sethtml":    setHtml,
-	"!leave":      leave,
-	"!blocklist":  blocklist,
-	"!bl":         blocklist,
-	"!view":       view,
+	"!help":             help,
+	"!login":            login,
+	"!logout":           logout,
+	"!setup":            setup,
+	"!write":            write,
+	"!drafts":           drafts,
+	"!draft":            draft,
+	"!ping":             ping,
+	"!setmailbox":       setMailbox,
+	"!sethtml":          setHtml,
+	"!setcatchup":       setCatchUp,
+	"!setmaxattachment": setMaxAttachment,
+	"!setreadsync":      setReadSync,
+	"!setredact":        setRedact,
+	"!setportals":       setPortals,
+	"!move":             move,
+	"!archive":          archive,
+	"!search":           search,
+	"!show":             show,
+	"!leave":            leave,
+	"!blocklist":        blocklist,
+	"!bl":               blocklist,
+	"!view":             view,
+	"!verify":           verify,
+	"!outbox":           outbox,
+	"!scheduled":        scheduled,
+	"!unschedule":       unschedule,
 }
 
 func help(evt *event.Event, message string) {
 	helpText := "-------- Help --------\r\n"
-	helpText += "!setup imap/smtp, host:port, username(em@ail.com), password, <mailbox (only for imap)>, ignoreSSLcert(true/false) - creates a bridge for this room\r\n"
+	helpText += "!setup imap/smtp, host:port, username(em@ail.com), password (or oauth:<provider>, ? for a password form), <mailbox (only for imap)>, ignoreSSLcert(true/false), <security(tls/starttls/plain)> - creates a bridge for this room\r\n"
 	helpText += "!ping - gets information about the email bridge for this room\r\n"
 	helpText += "!help - shows this command help overview\r\n"
-	helpText += "!write (receiver(s) email(s) splitted by space!) <markdown default:true>- sends an email to a given address\r\n"
+	helpText += "!write (receiver(s) email(s) splitted by space!) <cc:email> <bcc:email> <markdown default:true>- sends an email to a given address\r\n"
 	helpText += "!mailboxes - shows a list with all mailboxes available on your IMAP server\r\n"
 	helpText += "!setmailbox (mailbox) - changes the mailbox for the room\r\n"
 	helpText += "!mailbox - shows the currently selected mailbox\r\n"
 	helpText += "!sethtml (on/off or true/false) - sets HTML-rendering for messages on/off\r\n"
+	helpText += "!setcatchup (number) - sets how many missed emails get bridged after a downtime (0 = all)\r\n"
+	helpText += "!setmaxattachment (size in MB) - sets the maximum size of bridged attachments, 0 uses the default of the bridge\r\n"
+	helpText += "!setreadsync (on/off or true/false) - marks emails as read on the IMAP server when they are read in matrix\r\n"
+	helpText += "!setredact (trash/delete/off) - what happens to an email on the IMAP server when you redact it in matrix (default: off)\r\n"
+	helpText += "!setportals (off/correspondent/conversation) - posts new emails into an own room per correspondent or conversation\r\n"
 	helpText += "!logout remove email bridge from current room\r\n"
 	helpText += "!leave unbridge the current room and kick the bot\r\n"
+	helpText += "Reply to a bridged email in matrix to answer it\r\n"
+	helpText += "!move (mailbox) - moves the email you reply to into the given mailbox\r\n"
+	helpText += "!archive - moves the email you reply to into the archive\r\n"
+	helpText += "!search (from:, to:, subject:, since:YYYY-MM-DD, before:YYYY-MM-DD, unseen, text) - searches your mailbox\r\n"
+	helpText += "!show (number) - shows an email of the last search\r\n"
+	helpText += "!outbox (retry/cancel/relogin) - shows the emails waiting to be sent, sends them again or deletes them\r\n"
+	helpText += "!scheduled - shows the emails which are sent later\r\n"
+	helpText += "!unschedule (number) - cancels a scheduled email\r\n"
+	helpText += "!verify (yes/no) - confirms or rejects the emojis of a running device verification (encrypted rooms)\r\n"
 	helpText += "\r\n---- Email writing commands ----\r\n"
 	helpText += "!send - sends the email\r\n"
+	helpText += "!send at (08:00, 8am or 2006-01-02 15:04) / !send in (30m, 2h or 1d) - sends the email later\r\n"
+	helpText += "!preview - shows the email as it will be sent. Edit or remove a line by editing or removing its message\r\n"
+	helpText += "!cc/!bcc <email(s)> - adds recipients in copy/blind copy (clear removes all)\r\n"
 	helpText += "!rm <file> - removes given attachment from email\r\n"
-	matrixClient.SendText(evt.RoomID, helpText)
+	helpText += "!draft save - keeps the email as draft to continue it later\r\n"
+	helpText += "!drafts - lists the drafts of this room\r\n"
+	helpText += "!draft resume/discard (number) - continues writing or deletes a draft\r\n"
+	sendText(evt.RoomID, helpText)
 }
 
 func login(evt *event.Event, message string) {
-	matrixClient.SendText(evt.RoomID, "Okay send me the data of your server(at first IMAPs) in the given order, splitted by a comma(,)\r\n!setup imap, host:port, username/email, password, mailbox, ignoreSSL\r\n!setup smtp, host, port, email, password, ignoreSSL\r\n\r\nExample: \r\n!setup imap, host.com:993, mail@host.com, w0rdp4ss, INBOX, false\r\nor\r\n!setup smtp, host.com:587, mail@host.com, w0rdp4ss, false")
+	sendText(evt.RoomID, "Okay send me the data of your server(at first IMAPs) in the given order, splitted by a comma(,)\r\n!setup imap, host:port, username/email, password, mailbox, ignoreSSL, security(tls/starttls/plain, optional)\r\n!setup smtp, host:port, email, password, ignoreSSL, security(tls/starttls/plain, optional)\r\n\r\nExample: \r\n!setup imap, host.com:993, mail@host.com, w0rdp4ss, INBOX, false\r\nor\r\n!setup smtp, host.com:587, mail@host.com, w0rdp4ss, false\r\n\r\nUse oauth:<provider> (or xoauth2:<provider>/oauthbearer:<provider>) as password to login with OAuth2, e.g.\r\n!setup imap, imap.gmail.com:993, mail@gmail.com, oauth:google, INBOX, false\r\n\r\nUse ? as password to enter it in a one-time web form instead of this room. Messages containing your password get removed immediately")
 }
 
 func logout(evt *event.Event, mesage string) {
 	roomID := evt.RoomID
 	err := logOut(matrixClient, roomID.String(), false)
 	if err != nil {
-		matrixClient.SendText(roomID, "Error logging out: "+err.Error())
+		sendText(roomID, "Error logging out: "+err.Error())
 	} else {
-		matrixClient.SendText(roomID, "Successfully logged out")
+		sendText(roomID, "Successfully logged out")
 	}
 }
 
 func setup(evt *event.Event, message string) {
-	roomID := evt.RoomID
 	data := strings.Trim(strings.ReplaceAll(message, "!setup", ""), " ")
 	s := strings.Split(data, ",")
-	if len(s) < 4 || len(s) > 6 {
-		matrixClient.SendText(roomID, "Wrong syntax :/\r\nExample: \r\n!setup imap, host.com:993, mail@host.com, w0rdp4ss, INBOX, false\r\nor\r\n"+
+	if len(s) >= 4 {
+		password := strings.TrimSpace(s[3])
+		if password == askPassword && len(s) <= 7 {
+			requestPasswordForm(evt, s)
+			return
+		}
+		if _, _, isOAuth := parseOAuthPassword(password); !isOAuth && password != askPassword {
+			redactCredentials(evt)
+		}
+	}
+	setupAccount(evt, s)
+}
+
+//setupAccount creates an imap or smtp account from the comma separated values of !setup
+func setupAccount(evt *event.Event, s []string) {
+	roomID := evt.RoomID
+	if len(s) < 4 || len(s) > 7 {
+		sendText(roomID, "Wrong syntax :/\r\nExample: \r\n!setup imap, host.com:993, mail@host.com, w0rdp4ss, INBOX, false\r\nor\r\n"+
 			"!setup smtp, host.com:587, mail@host.com, w0rdp4ss, false")
 	} else {
 		accountType := s[0]
 		if strings.ToLower(accountType) != "imap" && strings.ToLower(accountType) != "smtp" {
-			matrixClient.SendText(roomID, "What? you can setup 'imap' and 'smtp', not \""+accountType+"\"")
+			sendText(roomID, "What? you can setup 'imap' and 'smtp', not \""+accountType+"\"")
 			return
 		}
 		host := strings.ReplaceAll(s[1], " ", "")
 		username := strings.ReplaceAll(s[2], " ", "")
-		password := strings.ReplaceAll(s[3], " ", "")
+		password := strings.TrimSpace(s[3])
+		authMethod := authPassword
+		oauthProvider := ""
+		if method, provider, ok := parseOAuthPassword(password); ok {
+			authMethod, oauthProvider = method, provider
+			password = ""
+		}
+		oauthToken := -1
 		ignoreSSlCert := false
+		security := ""
 		mailbox := "INBOX"
 		if len(s) >= 5 {
 			mailbox = strings.ReplaceAll(s[4], " ", "")
@@ -89,44 +146,67 @@ func setup(evt *event.Event, message string) {
 		defaultMailSyncInterval := viper.GetInt("defaultmailCheckInterval")
 		imapAccID, smtpAccID, erro := getRoomAccounts(string(roomID))
 		if erro != nil {
-			matrixClient.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #37")
+			sendText(roomID, "Something went wrong! Contact the admin. Errorcode: #37")
 			WriteLog(critical, "#37 checking getRoomAccounts: "+erro.Error())
 			return
 		}
 		if accountType == "imap" {
-			if len(s) == 6 {
+			if len(s) >= 6 {
 				ignoreSSlCert, err = strconv.ParseBool(strings.ReplaceAll(s[5], " ", ""))
 				if err != nil {
 					fmt.Println(err.Error())
 					ignoreSSlCert = false
 				}
 			}
+			if len(s) == 7 {
+				security, err = parseSecurity(s[6])
+				if err != nil {
+					sendText(roomID, err.Error())
+					return
+				}
+			} else {
+				security = securityTLS
+			}
 			if imapAccID != -1 {
-				matrixClient.SendText(roomID, "IMAP account already existing. Create a new room if you want to use a different account!")
+				sendText(roomID, "IMAP account already existing. Create a new room if you want to use a different account!")
 				return
 			}
 			isInUse, err := isImapAccountAlreadyInUse(username)
 			if err != nil {
-				matrixClient.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #03")
+				sendText(roomID, "Something went wrong! Contact the admin. Errorcode: #03")
 				WriteLog(critical, "#03 checking isImapAccountAlreadyInUse: "+err.Error())
 				return
 			}
 
 			if isInUse {
-				matrixClient.SendText(roomID, "This email is already in Use! You cannot use your email twice!")
+				sendText(roomID, "This email is already in Use! You cannot use your email twice!")
 				return
 			}
 
 			go func() {
 				if !strings.Contains(host, ":") {
-					host += ":993"
+					if security == securityTLS {
+						host += ":993"
+					} else {
+						host += ":143"
+					}
+				}
+
+				if authMethod != authPassword {
+					oauthToken, err = getOrCreateOAuthToken(roomID, oauthProvider, username)
+					if err != nil {
+						sendText(roomID, "OAuth authorization failed: "+err.Error())
+						WriteLog(logError, "#106 getOrCreateOAuthToken: "+err.Error())
+						return
+					}
 				}
 
-				mclient, err := loginMail(host, username, password, ignoreSSlCert)
+				account := imapAccountount{host, username, password, roomID.String(), mailbox, ignoreSSlCert, 0, defaultMailSyncInterval, viper.GetInt("defaultMaxCatchUp"), true, security, authMethod, oauthToken}
+				mclient, err := loginMail(&account)
 				if mclient != nil && err == nil {
 					has, er := hasRoom(string(roomID))
 					if er != nil {
-						matrixClient.SendText(roomID, "An error occured! contact your admin! Errorcode: #25")
+						sendText(roomID, "An error occured! contact your admin! Errorcode: #25")
 						WriteLog(critical, "checking imapAcc #25: "+er.Error())
 						return
 					}
@@ -134,7 +214,7 @@ func setup(evt *event.Event, message string) {
 					if !has {
 						newRoomID = insertNewRoom(string(roomID), defaultMailSyncInterval)
 						if newRoomID == -1 {
-							matrixClient.SendText(roomID, "An error occured! contact your admin! Errorcode: #26")
+							sendText(roomID, "An error occured! contact your admin! Errorcode: #26")
 							WriteLog(critical, "checking insertNewRoom #26")
 							return
 						}
@@ -142,62 +222,71 @@ func setup(evt *event.Event, message string) {
 						id, err := getRoomPKID(evt.RoomID.String())
 						if err != nil {
 							WriteLog(critical, "checking getRoomPKID #27: "+err.Error())
-							matrixClient.SendText(roomID, "An error occured! contact your admin! Errorcode: #27")
+							sendText(roomID, "An error occured! contact your admin! Errorcode: #27")
 							return
 						}
 						newRoomID = int64(id)
 					}
-					imapID, succes := insertimapAccountount(host, username, password, mailbox, ignoreSSlCert)
+					imapID, succes := insertimapAccountount(host, username, password, mailbox, ignoreSSlCert, security, authMethod, oauthToken)
 					if !succes {
-						matrixClient.SendText(roomID, "sth went wrong. Contact your admin")
+						sendText(roomID, "sth went wrong. Contact your admin")
 						return
 					}
 					err = saveImapAcc(string(roomID), int(imapID))
 					if err != nil {
 						WriteLog(critical, "saveImapAcc #35 : "+err.Error())
-						matrixClient.SendText(roomID, "sth went wrong. Contact you admin! Errorcode: #35")
+						sendText(roomID, "sth went wrong. Contact you admin! Errorcode: #35")
 						return
 					}
-					matrixClient.SendText(roomID, "Bridge created successfully!\r\nYou should delete the message containing your credentials ;)\r\nIMAP:\r\n"+
+					sendText(roomID, "Bridge created successfully!\r\nIMAP:\r\n"+
 						"host: "+host+"\r\n"+
 						"username: "+username+"\r\n"+
 						"mailbox: "+mailbox+"\r\n"+
-						"ignoreSSL: "+strconv.FormatBool(ignoreSSlCert))
+						"ignoreSSL: "+strconv.FormatBool(ignoreSSlCert)+"\r\n"+
+						"security: "+security)
 
-					startMailListener(imapAccountount{host, username, password, roomID.String(), mailbox, ignoreSSlCert, int(newRoomID), defaultMailSyncInterval, true})
+					account.roomPKID = int(newRoomID)
+					startMailListener(account)
 					WriteLog(success, "Created new bridge and started maillistener\r\n")
 				} else {
-					matrixClient.SendText(roomID, "Error creating bridge! Errorcode: #04\r\nReason: "+err.Error())
+					sendText(roomID, "Error creating bridge! Errorcode: #04\r\nReason: "+err.Error())
 					WriteLog(logError, "#04 creating bridge: "+err.Error())
 				}
 			}()
 		} else if accountType == "smtp" {
 			if smtpAccID != -1 {
-				matrixClient.SendText(roomID, "SMTP account already existing. Create a new room if you want to use a different account!")
+				sendText(roomID, "SMTP account already existing. Create a new room if you want to use a different account!")
 				return
 			}
 			isInUse, err := isSMTPAccountAlreadyInUse(username)
 			if err != nil {
-				matrixClient.SendText(roomID, "Something went wrong! Contact the admin. Errorcode: #24")
+				sendText(roomID, "Something went wrong! Contact the admin. Errorcode: #24")
 				WriteLog(critical, "#24 checking isSMTPAccountAlreadyInUse: "+err.Error())
 				return
 			}
 			if isInUse {
-				matrixClient.SendText(roomID, "This smtp-username is already in Use! You cannot use your email twice!")
+				sendText(roomID, "This smtp-username is already in Use! You cannot use your email twice!")
 				return
 			}
 
 			go func() {
-				if len(s) == 5 {
+				if len(s) >= 5 {
 					ignoreSSlCert, err = strconv.ParseBool(strings.ReplaceAll(s[4], " ", ""))
 					if err != nil {
 						fmt.Println(err.Error())
 						ignoreSSlCert = false
 					}
 				}
+				if len(s) == 6 {
+					security, err = parseSecurity(s[5])
+					if err != nil {
+						sendText(roomID, err.Error())
+						return
+					}
+				}
 				has, er := hasRoom(roomID.String())
 				if er != nil {
-					matrixClient.SendText(roomID, "An error occured! contact your admin! Errorcode: #28")
+					sendText(roomID, "An error occured! contact your admin! Errorcode: #28")
 					WriteLog(critical, "checking imapAcc #28: "+er.Error())
 					return
 				}
@@ -205,7 +294,7 @@ func setup(evt *event.Event, message string) {
 				if !has {
 					newRoomID = insertNewRoom(roomID.String(), defaultMailSyncInterval)
 					if newRoomID == -1 {
-						matrixClient.SendText(roomID, "An error occured! contact your admin! Errorcode: #29")
+						sendText(roomID, "An error occured! contact your admin! Errorcode: #29")
 						WriteLog(critical, "checking insertNewRoom #29: ")
 						return
 					}
@@ -213,43 +302,62 @@ func setup(evt *event.Event, message string) {
 					id, err := getRoomPKID(evt.RoomID.String())
 					if err != nil {
 						WriteLog(critical, "checking getRoomPKID #30: "+err.Error())
-						matrixClient.SendText(roomID, "An error occured! contact your admin! Errorcode: #30")
+						sendText(roomID, "An error occured! contact your admin! Errorcode: #30")
 						return
 					}
 					newRoomID = int64(id)
 				}
 				port := 587
 				if !strings.Contains(host, ":") {
-					matrixClient.SendText(roomID, "No port specified! Using 587")
+					sendText(roomID, "No port specified! Using 587")
 				} else {
 					hostsplit := strings.Split(host, ":")
 					host = hostsplit[0]
 					port, err = strconv.Atoi(strings.Trim(hostsplit[1], " "))
 					if err != nil {
-						matrixClient.SendText(roomID, "The port must be a number!")
+						sendText(roomID, "The port must be a number!")
+						return
+					}
+				}
+				if len(security) == 0 {
+					security = securityStartTLS
+					if port == 465 {
+						security = securityTLS
+					}
+				}
+				if security == securityPlain && !isLoopbackHost(host) {
+					sendText(roomID, "Unencrypted connections are only allowed to localhost")
+					return
+				}
+				if authMethod != authPassword {
+					oauthToken, err = getOrCreateOAuthToken(roomID, oauthProvider, username)
+					if err != nil {
+						sendText(roomID, "OAuth authorization failed: "+err.Error())
+						WriteLog(logError, "#107 getOrCreateOAuthToken: "+err.Error())
 						return
 					}
 				}
-				smtpID, err := insertSMTPAccountount(host, port, username, password, ignoreSSlCert)
+				smtpID, err := insertSMTPAccountount(host, port, username, password, ignoreSSlCert, security, authMethod, oauthToken)
 				if err != nil {
-					matrixClient.SendText(roomID, "sth went wrong. Contact your admin")
+					sendText(roomID, "sth went wrong. Contact your admin")
 					return
 				}
 				err = saveSMTPAcc(roomID.String(), int(smtpID))
 				if err != nil {
 					WriteLog(critical, "saveSMTPAcc #36 : "+err.Error())
-					matrixClient.SendText(roomID, "sth went wrong. Contact you admin! Errorcode: #34")
+					sendText(roomID, "sth went wrong. Contact you admin! Errorcode: #34")
 					return
 				}
 
-				matrixClient.SendText(roomID, "SMTP data saved.\r\nSMTP:\r\n"+
+				sendText(roomID, "SMTP data saved.\r\nSMTP:\r\n"+
 					"host: "+host+"\r\n"+
 					"port: "+strconv.Itoa(port)+"\r\n"+
 					"username: "+username+"\r\n"+
-					"ignoreSSL: "+strconv.FormatBool(ignoreSSlCert))
+					"ignoreSSL: "+strconv.FormatBool(ignoreSSlCert)+"\r\n"+
+					"security: "+security)
 			}()
 		} else {
-			matrixClient.SendText(roomID, "Not implemented yet!")
+			sendText(roomID, "Not implemented yet!")
 		}
 	}
 }
@@ -260,54 +368,51 @@ func write(evt *event.Event, message string) {
 		_, smtpAccID, erro := getRoomAccounts(roomID.String())
 		if erro != nil {
 			WriteLog(critical, "#38 getRoomAccounts: "+erro.Error())
-			matrixClient.SendText(roomID, "An server-error occured Errorcode: #38")
+			sendText(roomID, "An server-error occured Errorcode: #38")
 			return
 		}
 		if smtpAccID == -1 {
-			matrixClient.SendText(roomID, "You have to setup an smtp account. Type !help or !login for more information")
+			sendText(roomID, "You have to setup an smtp account. Type !help or !login for more information")
 			return
 		}
 		s := strings.Split(message, " ")
-		if len(s) > 1 {
-			receiver := strings.Trim(s[1], " ")
-			if len(s) > 2 {
-				receiverString := ""
-				for i := 1; i < len(s); i++ {
-					recEmail := strings.Trim(s[i], " ")
-					if len(recEmail) == 0 || !strings.Contains(recEmail, "@") || !strings.Contains(recEmail, ".") || strings.Contains(receiverString, recEmail) {
-						continue
-					}
-					add := ","
-					if strings.HasSuffix(recEmail, ",") {
-						add = ""
-					}
-					receiverString += strings.Trim(s[i], " ") + add
+		if len(strings.TrimSpace(message)) > 0 {
+			var receivers, cc, bcc []string
+			for i := 0; i < len(s); i++ {
+				recEmail := strings.Trim(s[i], " ")
+				if lower := strings.ToLower(recEmail); strings.HasPrefix(lower, "cc:") {
+					cc = addRecipients(cc, recEmail[3:])
+				} else if strings.HasPrefix(lower, "bcc:") {
+					bcc = addRecipients(bcc, recEmail[4:])
+				} else {
+					receivers = addRecipients(receivers, recEmail)
 				}
-				receiver = receiverString[:len(receiverString)-1]
 			}
+			receiver := strings.Join(receivers, ",")
 
 			if strings.Contains(receiver, "@") && strings.Contains(receiver, ".") && len(receiver) > 5 {
 				hasTemp, err := isUserWritingEmail(roomID.String())
 				if err != nil {
 					WriteLog(critical, "#39 isUserWritingEmail: "+err.Error())
-					matrixClient.SendText(roomID, "An server-error occured Errorcode: #39")
+					sendText(roomID, "An server-error occured Errorcode: #39")
 					return
 				}
 				if hasTemp {
-					er := deleteWritingTemp(roomID.String())
+					er := pauseWritingTemp(roomID.String())
 					if er != nil {
-						WriteLog(critical, "#40 deleteWritingTemp: "+er.Error())
-						matrixClient.SendText(roomID, "An server-error occured Errorcode: #40")
+						WriteLog(critical, "#40 pauseWritingTemp: "+er.Error())
+						sendText(roomID, "An server-error occured Errorcode: #40")
 						return
 					}
+					sendText(roomID, "The email you were writing was kept as draft. Type !drafts to see all drafts")
 				}
 
 				mrkdwn := 0
 				if viper.GetBool("markdownEnabledByDefault") {
 					mrkdwn = 1
 				}
-				if len(s) == 3 {
-					mdwn, berr := strconv.ParseBool(s[2])
+				if len(s) > 1 {
+					mdwn, berr := strconv.ParseBool(s[len(s)-1])
 					if berr == nil {
 						if mdwn {
 							mrkdwn = 1
@@ -321,38 +426,108 @@ func write(evt *event.Event, message string) {
 				saveWritingtemp(roomID.String(), "markdown", strconv.Itoa(mrkdwn))
 				if err != nil {
 					WriteLog(critical, "#42 newWritingTemp: "+err.Error())
-					matrixClient.SendText(roomID, "An server-error occured Errorcode: #42")
+					sendText(roomID, "An server-error occured Errorcode: #42")
 					return
 				}
-				matrixClient.SendText(roomID, "Now send me the subject of your email")
+				saveWritingtemp(roomID.String(), "cc", strings.Join(cc, ","))
+				saveWritingtemp(roomID.String(), "bcc", strings.Join(bcc, ","))
+				sendText(roomID, "Now send me the subject of your email")
 			} else {
-				matrixClient.SendText(roomID, "this is an email: max@google.de\r\nthis is no email: "+receiver)
+				sendText(roomID, "this is an email: max@google.de\r\nthis is no email: "+s[0])
 			}
 		} else {
-			matrixClient.SendText(roomID, "Usage: !write <emailaddress>")
+			sendText(roomID, "Usage: !write <emailaddress> [cc:<emailaddress>] [bcc:<emailaddress>]")
 		}
 	} else {
-		matrixClient.SendText(roomID, "You have to login to use this command!")
+		sendText(roomID, "You have to login to use this command!")
 	}
 }
 
+//addRecipients adds the comma separated addresses to list, skipping invalid ones and duplicates
+func addRecipients(list []string, addresses string) []string {
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		if len(address) <= 5 || !strings.Contains(address, "@") || !strings.Contains(address, ".") {
+			continue
+		}
+		duplicate := false
+		for _, existing := range list {
+			if strings.EqualFold(existing, address) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			list = append(list, address)
+		}
+	}
+	return list
+}
+
+//splitRecipients returns the addresses of a comma separated recipient column
+func splitRecipients(addresses string) []string {
+	return addRecipients(nil, addresses)
+}
+
+//recipientSummary lists all recipients of an email in writing
+func recipientSummary(writeTemp *emailTemp) string {
+	summary := "To: " + strings.Join(splitRecipients(writeTemp.receiver), ", ")
+	if cc := splitRecipients(writeTemp.cc); len(cc) > 0 {
+		summary += "\r\nCc: " + strings.Join(cc, ", ")
+	}
+	if bcc := splitRecipients(writeTemp.bcc); len(bcc) > 0 {
+		summary += "\r\nBcc: " + strings.Join(bcc, ", ")
+	}
+	return summary
+}
+
+//setCopyRecipients handles !cc and !bcc while writing an email
+func setCopyRecipients(roomID id.RoomID, writeTemp *emailTemp, key, args string) {
+	current := writeTemp.cc
+	if key == "bcc" {
+		current = writeTemp.bcc
+	}
+	var value string
+	if args == "clear" {
+		value = ""
+	} else {
+		added := addRecipients(splitRecipients(current), strings.ReplaceAll(args, " ", ","))
+		if len(added) == len(splitRecipients(current)) {
+			sendText(roomID, "Usage: !"+key+" <emailaddress(es)> or !"+key+" clear")
+			return
+		}
+		value = strings.Join(added, ",")
+	}
+	if err := saveWritingtemp(string(roomID), key, value); err != nil {
+		WriteLog(critical, "#133 saveWritingtemp: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #133")
+		return
+	}
+	if key == "cc" {
+		writeTemp.cc = value
+	} else {
+		writeTemp.bcc = value
+	}
+	sendText(roomID, recipientSummary(writeTemp))
+}
+
 func ping(evt *event.Event, message string) {
 	roomID := evt.RoomID
 	if has, err := hasRoom(roomID.String()); has && err == nil {
 		roomData, err := getRoomInfo(roomID.String())
 		if err != nil {
 			WriteLog(logError, "#006 getRoomInfo: "+err.Error())
-			matrixClient.SendText(roomID, "An server-error occured")
+			sendText(roomID, "An server-error occured")
 			return
 		}
 
-		matrixClient.SendText(roomID, roomData)
+		sendText(roomID, roomData)
 	} else {
 		if err != nil {
 			WriteLog(logError, "#06 hasRoom: "+err.Error())
-			matrixClient.SendText(roomID, "An server-error occured")
+			sendText(roomID, "An server-error occured")
 		} else {
-			matrixClient.SendText(roomID, "You have to login to use this command!")
+			sendText(roomID, "You have to login to use this command!")
 		}
 	}
 }
@@ -362,7 +537,7 @@ func setMailbox(evt *event.Event, message string) {
 	imapAccID, _, erro := getRoomAccounts(roomID.String())
 	if erro != nil {
 		WriteLog(critical, "#48 getRoomAccounts: "+erro.Error())
-		matrixClient.SendText(roomID, "An server-error occured Errorcode: #48")
+		sendText(roomID, "An server-error occured Errorcode: #48")
 		return
 	}
 	if imapAccID != -1 {
@@ -370,22 +545,22 @@ func setMailbox(evt *event.Event, message string) {
 		if len(d) == 2 {
 			mailbox := d[1]
 			saveMailbox(roomID.String(), mailbox)
-			deleteMails(roomID.String())
+			deleteMailboxStates(roomID.String())
 			stopMailChecker(roomID.String())
 			imapAccount, err := getIMAPAccount(roomID.String())
 			if err != nil {
 				WriteLog(critical, "#49 getIMAPAccount: "+err.Error())
-				matrixClient.SendText(roomID, "An server-error occured Errorcode: #49")
+				sendText(roomID, "An server-error occured Errorcode: #49")
 				return
 			}
 			imapAccount.silence = true
 			go startMailListener(*imapAccount)
-			matrixClient.SendText(roomID, "Mailbox updated")
+			sendText(roomID, "Mailbox updated")
 		} else {
-			matrixClient.SendText(roomID, "Usage: !setmailbox <new mailbox>")
+			sendText(roomID, "Usage: !setmailbox <new mailbox>")
 		}
 	} else {
-		matrixClient.SendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		sendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
 	}
 }
 
@@ -394,7 +569,7 @@ func setHtml(evt *event.Event, message string) {
 	imapAccID, _, erro := getRoomAccounts(roomID.String())
 	if erro != nil {
 		WriteLog(critical, "#50 getRoomAccounts: "+erro.Error())
-		matrixClient.SendText(roomID, "An server-error occured Errorcode: #50")
+		sendText(roomID, "An server-error occured Errorcode: #50")
 		return
 	}
 	if imapAccID != -1 {
@@ -405,21 +580,180 @@ func setHtml(evt *event.Event, message string) {
 			if newMode == "true" || newMode == "on" {
 				newModeB = true
 			} else if newMode != "false" && newMode != "off" {
-				matrixClient.SendText(roomID, "What?\r\non/off or true/false")
+				sendText(roomID, "What?\r\non/off or true/false")
 				return
 			}
 			err := setHTMLenabled(roomID.String(), newModeB)
 			if err != nil {
 				WriteLog(critical, "#56 getMailbox: "+err.Error())
-				matrixClient.SendText(roomID, "An server-error occured Errorcode: #56")
+				sendText(roomID, "An server-error occured Errorcode: #56")
+				return
+			}
+			sendText(roomID, "Successfully set HTML-rendering to "+newMode)
+		} else {
+			sendText(roomID, "Usage: !sethtml (on/of) or (true/false)")
+		}
+	} else {
+		sendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+	}
+}
+
+func setCatchUp(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	imapAccID, _, erro := getRoomAccounts(roomID.String())
+	if erro != nil {
+		WriteLog(critical, "#69 getRoomAccounts: "+erro.Error())
+		sendText(roomID, "An server-error occured Errorcode: #69")
+		return
+	}
+	if imapAccID != -1 {
+		limit := strings.TrimSpace(message)
+		if len(limit) > 0 {
+			maxCatchUp, err := strconv.Atoi(limit)
+			if err != nil || maxCatchUp < 0 {
+				sendText(roomID, "The limit must be a positive number!")
+				return
+			}
+			err = setMaxCatchUp(roomID.String(), maxCatchUp)
+			if err != nil {
+				WriteLog(critical, "#70 setMaxCatchUp: "+err.Error())
+				sendText(roomID, "An server-error occured Errorcode: #70")
+				return
+			}
+			stopMailChecker(roomID.String())
+			imapAccount, err := getIMAPAccount(roomID.String())
+			if err != nil {
+				WriteLog(critical, "#71 getIMAPAccount: "+err.Error())
+				sendText(roomID, "An server-error occured Errorcode: #71")
 				return
 			}
-			matrixClient.SendText(roomID, "Successfully set HTML-rendering to "+newMode)
+			go startMailListener(*imapAccount)
+			sendText(roomID, "Successfully set catch-up limit to "+limit)
+		} else {
+			sendText(roomID, "Usage: !setcatchup <max emails>")
+		}
+	} else {
+		sendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+	}
+}
+
+func setMaxAttachment(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	imapAccID, _, erro := getRoomAccounts(roomID.String())
+	if erro != nil {
+		WriteLog(critical, "#76 getRoomAccounts: "+erro.Error())
+		sendText(roomID, "An server-error occured Errorcode: #76")
+		return
+	}
+	if imapAccID != -1 {
+		size := strings.TrimSpace(message)
+		if len(size) > 0 {
+			maxSize, err := strconv.Atoi(size)
+			if err != nil || maxSize < 0 {
+				sendText(roomID, "The size must be a positive number!")
+				return
+			}
+			err = setMaxAttachmentSize(roomID.String(), maxSize)
+			if err != nil {
+				WriteLog(critical, "#77 setMaxAttachmentSize: "+err.Error())
+				sendText(roomID, "An server-error occured Errorcode: #77")
+				return
+			}
+			if maxSize == 0 {
+				sendText(roomID, "Successfully reset the maximum attachment size to the default of the bridge")
+			} else {
+				sendText(roomID, "Successfully set the maximum attachment size to "+size+" MB")
+			}
 		} else {
-			matrixClient.SendText(roomID, "Usage: !sethtml (on/of) or (true/false)")
+			sendText(roomID, "Usage: !setmaxattachment <size in MB> (0 uses the default of the bridge)")
 		}
 	} else {
-		matrixClient.SendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		sendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+	}
+}
+
+func setReadSync(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	imapAccID, _, erro := getRoomAccounts(roomID.String())
+	if erro != nil {
+		WriteLog(critical, "#91 getRoomAccounts: "+erro.Error())
+		sendText(roomID, "An server-error occured Errorcode: #91")
+		return
+	}
+	if imapAccID != -1 {
+		newMode := strings.ToLower(strings.TrimSpace(message))
+		newModeB := false
+		if newMode == "true" || newMode == "on" {
+			newModeB = true
+		} else if newMode != "false" && newMode != "off" {
+			sendText(roomID, "Usage: !setreadsync (on/off) or (true/false)")
+			return
+		}
+		err := setReadSyncEnabled(roomID.String(), newModeB)
+		if err != nil {
+			WriteLog(critical, "#92 setReadSyncEnabled: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #92")
+			return
+		}
+		sendText(roomID, "Successfully set read state sync to "+newMode)
+	} else {
+		sendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+	}
+}
+
+func setRedact(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	imapAccID, _, erro := getRoomAccounts(roomID.String())
+	if erro != nil {
+		WriteLog(critical, "#97 getRoomAccounts: "+erro.Error())
+		sendText(roomID, "An server-error occured Errorcode: #97")
+		return
+	}
+	if imapAccID != -1 {
+		action := strings.ToLower(strings.TrimSpace(message))
+		if action != redactActionTrash && action != redactActionDelete && action != redactActionOff {
+			sendText(roomID, "Usage: !setredact (trash/delete/off)")
+			return
+		}
+		err := setRedactAction(roomID.String(), action)
+		if err != nil {
+			WriteLog(critical, "#98 setRedactAction: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #98")
+			return
+		}
+		sendText(roomID, "Redacted emails will now be handled with: "+action)
+	} else {
+		sendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+	}
+}
+
+func setPortals(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	imapAccID, _, erro := getRoomAccounts(roomID.String())
+	if erro != nil {
+		WriteLog(critical, "#131 getRoomAccounts: "+erro.Error())
+		sendText(roomID, "An server-error occured Errorcode: #131")
+		return
+	}
+	if imapAccID != -1 {
+		mode := strings.ToLower(strings.TrimSpace(message))
+		if mode != portalModeOff && mode != portalModeCorrespondent && mode != portalModeConversation {
+			sendText(roomID, "Usage: !setportals (off/correspondent/conversation)")
+			return
+		}
+		err := setPortalMode(roomID.String(), mode)
+		if err != nil {
+			WriteLog(critical, "#132 setPortalMode: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #132")
+			return
+		}
+		if mode == portalModeOff {
+			sendText(roomID, "New emails will be posted into this room")
+		} else {
+			sendText(roomID, "New emails will be posted into an own room per "+mode+". Messages written there are sent to the correspondent")
+		}
+	} else {
+		sendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
 	}
 }
 
@@ -427,9 +761,9 @@ func leave(evt *event.Event, message string) {
 	roomID := evt.RoomID
 	err := logOut(matrixClient, roomID.String(), true)
 	if err != nil {
-		matrixClient.SendText(roomID, "Error leaving: "+err.Error())
+		sendText(roomID, "Error leaving: "+err.Error())
 	} else {
-		matrixClient.SendText(roomID, "Successfully unbridged")
+		sendText(roomID, "Successfully unbridged")
 	}
 }
 
@@ -437,7 +771,7 @@ func blocklist(evt *event.Event, message string) {
 	roomID := evt.RoomID
 	imapAccID, _, _ := getRoomAccounts(roomID.String())
 	if imapAccID == -1 {
-		matrixClient.SendText(roomID, "You need to login with an imap account to use this command!")
+		sendText(roomID, "You need to login with an imap account to use this command!")
 		return
 	}
 	sm := strings.Split(message, " ")
@@ -453,15 +787,15 @@ func blocklist(evt *event.Event, message string) {
 			} else {
 				msg = "Blocklist is now clean!"
 			}
-			matrixClient.SendText(roomID, msg)
+			sendText(roomID, msg)
 		} else {
-			matrixClient.SendText(roomID, "Usage: !blocklist <add/delete/clear/view> <email address>\nDon't show any emails from a given email address.\nWildcards (like *@evilEmailAddress.com) are supported")
+			sendText(roomID, "Usage: !blocklist <add/delete/clear/view> <email address>\nDon't show any emails from a given email address.\nWildcards (like *@evilEmailAddress.com) are supported")
 		}
 	} else {
 		cmd := strings.ToLower(sm[1])
 		addr := sm[2]
 		if !strings.Contains(addr, "@") || !strings.Contains(addr, ".") || len(addr) < 6 {
-			matrixClient.SendText(roomID, "Error! "+addr+" is an invalid email address!")
+			sendText(roomID, "Error! "+addr+" is an invalid email address!")
 		} else {
 			switch cmd {
 			case "add":
@@ -475,7 +809,7 @@ func blocklist(evt *event.Event, message string) {
 					} else {
 						msg = "Success adding " + addr + " to blocklist!"
 					}
-					matrixClient.SendText(roomID, msg)
+					sendText(roomID, msg)
 				}
 			case "remove", "delete", "rm":
 				{
@@ -487,7 +821,7 @@ func blocklist(evt *event.Event, message string) {
 					} else {
 						msg = "Success deleting " + addr + " from blocklist!"
 					}
-					matrixClient.SendText(roomID, msg)
+					sendText(roomID, msg)
 				}
 			}
 		}
@@ -498,7 +832,7 @@ func view(evt *event.Event, message string) {
 	roomID := evt.RoomID
 	imapAccID, _, _ := getRoomAccounts(roomID.String())
 	if imapAccID == -1 {
-		matrixClient.SendText(roomID, "You need to login with an imap account to use this command!")
+		sendText(roomID, "You need to login with an imap account to use this command!")
 		return
 	}
 	sm := strings.Split(message, " ")
@@ -530,34 +864,178 @@ func view(evt *event.Event, message string) {
 	}
 }
 
+//drafts lists the drafts of the room
+func drafts(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	list, err := getDrafts(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#134 getDrafts: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #134")
+		return
+	}
+	if len(list) == 0 {
+		sendText(roomID, "There are no drafts in this room")
+		return
+	}
+	activePK := -1
+	if writeTemp, err := getWritingTemp(roomID.String()); err == nil {
+		activePK = writeTemp.pkID
+	}
+
+	text := "Drafts:\r\n"
+	for _, d := range list {
+		text += strconv.Itoa(d.pkID) + ": " + draftTitle(&d)
+		if attachments, err := getAttachments(d.pkID); err == nil && len(attachments) > 0 {
+			text += " (" + strconv.Itoa(len(attachments)) + " attachments)"
+		}
+		if d.pkID == activePK {
+			text += " - writing"
+		}
+		text += "\r\n"
+	}
+	sendText(roomID, text+"Continue a draft with !draft resume (number) or delete it with !draft discard (number)")
+}
+
+//draft saves, resumes or discards drafts
+func draft(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	action, number, _ := strings.Cut(strings.TrimSpace(message), " ")
+	switch action {
+	case "save":
+		is, err := isUserWritingEmail(roomID.String())
+		if err != nil {
+			WriteLog(critical, "#135 isUserWritingEmail: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #135")
+			return
+		}
+		if !is {
+			sendText(roomID, "You aren't writing an email")
+			return
+		}
+		if err = pauseWritingTemp(roomID.String()); err != nil {
+			WriteLog(critical, "#153 pauseWritingTemp: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #153")
+			return
+		}
+		sendText(roomID, "Draft saved. Type !drafts to continue it later")
+	case "resume", "discard":
+		pkID, err := strconv.Atoi(strings.TrimSpace(number))
+		if err != nil {
+			sendText(roomID, "Usage: !draft "+action+" (number)")
+			return
+		}
+		var found bool
+		if action == "resume" {
+			found, err = resumeDraft(roomID.String(), pkID)
+		} else {
+			found, err = deleteDraft(roomID.String(), pkID)
+		}
+		if err != nil {
+			WriteLog(critical, "#136 "+action+" draft: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #136")
+			return
+		}
+		if !found {
+			sendText(roomID, "There is no draft "+number+". Type !drafts to see all drafts")
+			return
+		}
+		if action == "discard" {
+			sendText(roomID, "Draft deleted")
+			return
+		}
+
+		writeTemp, err := getWritingTemp(roomID.String())
+		if err != nil {
+			WriteLog(critical, "#137 getWritingTemp: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #137")
+			return
+		}
+		previewDraft(roomID, writeTemp)
+		if len(strings.TrimSpace(writeTemp.subject)) == 0 {
+			sendText(roomID, "Now send me the subject of your email")
+		} else {
+			sendText(roomID, "Continue writing the email. If you want to send or cancel enter !send or !cancel")
+		}
+	default:
+		sendText(roomID, "Usage: !draft save, !draft resume (number) or !draft discard (number)")
+	}
+}
+
+//previewDraft shows the email in writing as it will be sent
+func previewDraft(roomID id.RoomID, writeTemp *emailTemp) {
+	header := recipientSummary(writeTemp) + "\r\nSubject: " + writeTemp.subject
+	var footer string
+	if attachments, err := getAttachments(writeTemp.pkID); err == nil && len(attachments) > 0 {
+		footer = "\r\nAttachments: " + strings.Join(attachments, ", ")
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    header + "\r\n\r\n" + writeTemp.body + footer,
+	}
+	if writeTemp.markdown {
+		content.Format = event.FormatHTML
+		content.FormattedBody = strings.ReplaceAll(html.EscapeString(header), "\r\n", "<br>") + "<hr>" + markdownToHTML(writeTemp.body) + strings.ReplaceAll(html.EscapeString(footer), "\r\n", "<br>")
+	}
+	sendMessageEvent(roomID, event.EventMessage, content)
+}
+
+//draftTitle describes a draft in one line
+func draftTitle(writeTemp *emailTemp) string {
+	subject := strings.TrimSpace(writeTemp.subject)
+	if len(subject) == 0 {
+		subject = "(no subject)"
+	}
+	return strings.Join(splitRecipients(writeTemp.receiver), ", ") + " - " + subject
+}
+
 func writingEmail(evt *event.Event, message string) {
 	roomID := evt.RoomID
 	writeTemp, err := getWritingTemp(string(roomID))
 	if err != nil {
 		WriteLog(critical, "#43 getWritingTemp: "+err.Error())
-		matrixClient.SendText(roomID, "An server-error occured Errorcode: #43")
+		sendText(roomID, "An server-error occured Errorcode: #43")
 		deleteWritingTemp(string(roomID))
 		return
 	}
+	command, args, _ := strings.Cut(message, " ")
+	switch command {
+	case "!cc", "!bcc":
+		setCopyRecipients(roomID, writeTemp, command[1:], strings.TrimSpace(args))
+		return
+	case "!drafts":
+		drafts(evt, args)
+		return
+	case "!draft":
+		draft(evt, args)
+		return
+	}
 	if len(strings.Trim(writeTemp.subject, " ")) == 0 {
 		if evt.Content.AsMessage().MsgType != event.MsgText {
-			matrixClient.SendText(roomID, "You have to send a text for subject!")
+			sendText(roomID, "You have to send a text for subject!")
 			return
 		}
 		err = saveWritingtemp(string(roomID), "subject", message)
 		if err != nil {
 			WriteLog(critical, "#44 saveWritingtemp: "+err.Error())
-			matrixClient.SendText(roomID, "An server-error occured Errorcode: #44")
+			sendText(roomID, "An server-error occured Errorcode: #44")
 			deleteWritingTemp(string(roomID))
 			return
 		}
-		matrixClient.SendText(roomID, "Now send me the content of the email. One message is one line. If you want to send or cancel enter !send or !cancel")
+		sendText(roomID, "Now send me the content of the email. One message is one line. Add recipients in copy with !cc or !bcc. If you want to send or cancel enter !send or !cancel. !draft save keeps the email to continue it later")
 	} else {
-		if message == "!send" {
+		if command == "!send" {
+			var sendAt time.Time
+			if len(strings.TrimSpace(args)) > 0 {
+				sendAt, err = parseSendTime(args, time.Now())
+				if err != nil {
+					sendText(roomID, err.Error())
+					return
+				}
+			}
 			account, err := getSMTPAccount(string(roomID))
 			if err != nil {
 				WriteLog(critical, "#52 saveWritingtemp: "+err.Error())
-				matrixClient.SendText(roomID, "An server-error occured Errorcode: #52")
+				sendText(roomID, "An server-error occured Errorcode: #52")
 				deleteWritingTemp(string(roomID))
 				return
 			}
@@ -571,51 +1049,43 @@ func writingEmail(evt *event.Event, message string) {
 			} else {
 				m.SetHeader("To", writeTemp.receiver)
 			}
+			if cc := splitRecipients(writeTemp.cc); len(cc) > 0 {
+				m.SetHeader("Cc", cc...)
+			}
+			if bcc := splitRecipients(writeTemp.bcc); len(bcc) > 0 {
+				m.SetHeader("Bcc", bcc...)
+			}
 
 			m.SetHeader("Subject", writeTemp.subject)
 
-			if writeTemp.markdown {
-				toSendText := string(markdown.ToHTML([]byte(writeTemp.body), nil, nil))
-				toSendText = strings.ReplaceAll(toSendText, "\r\n<h", "<h")
-				toSendText = strings.ReplaceAll(toSendText, "\n\n<h", "<h")
-				toSendText = strings.ReplaceAll(toSendText, ">\n\n", ">")
-				toSendText = strings.ReplaceAll(toSendText, "\r\n", "<br>")
-				m.SetBody("text/html", toSendText)
-
-				plainbody := writeTemp.body
-				plainbody = strings.ReplaceAll(plainbody, "<br>", "\r\n")
-				m.AddAlternative("text/plain", plainbody)
-			} else {
-				m.SetBody("text/plain", writeTemp.body)
-			}
+			setMailBody(m, writeTemp.body, writeTemp.markdown)
 
 			attachments, err := getAttachments(writeTemp.pkID)
 			if err == nil {
 				for _, i := range attachments {
-					matrixClient.SendText(roomID, "Attaching file: "+i)
+					sendText(roomID, "Attaching file: "+i)
 					m.Attach(tempDir + i)
 				}
 			} else {
-				matrixClient.SendText(roomID, "coulnd't attach files: "+err.Error())
+				sendText(roomID, "coulnd't attach files: "+err.Error())
 			}
 
-			d := gomail.NewDialer(account.host, account.port, account.username, account.password)
-			if account.ignoreSSL {
-				d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+			if sendAt.IsZero() {
+				sendText(roomID, "Sending to\r\n"+recipientSummary(writeTemp))
+			} else {
+				sendText(roomID, "Sending at "+sendAt.Format(scheduleTimeFormat)+" to\r\n"+recipientSummary(writeTemp)+"\r\nType !scheduled to see all scheduled emails")
 			}
-			matrixClient.SendText(roomID, "Sending...")
-			if err := d.DialAndSend(m); err != nil {
-				WriteLog(logError, "#46 DialAndSend: "+err.Error())
-				matrixClient.SendText(roomID, "An server-error occured Errorcode: #53\r\n"+err.Error())
-				removeSMTPAccount(string(roomID))
-				matrixClient.SendText(roomID, "To fix this errer you have to run !setup smtp .... again")
-				deleteWritingTemp(string(roomID))
+			//the draft is kept if the email can't be queued
+			if err := queueMail(string(roomID), m, writeTemp.subject, sendAt); err != nil {
+				WriteLog(critical, "#53 queueMail: "+err.Error())
+				sendText(roomID, "An server-error occured Errorcode: #53\r\n"+err.Error())
 				return
 			}
-			matrixClient.SendText(roomID, "Message sent successfully")
 			deleteWritingTemp(string(roomID))
+		} else if message == "!preview" {
+			previewDraft(roomID, writeTemp)
 		} else if message == "!cancel" {
-			matrixClient.SendText(roomID, "Mail canceled")
+			sendText(roomID, "Mail canceled")
 			deleteWritingTemp(string(roomID))
 			return
 		} else if strings.HasPrefix(message, "!rm") && len(strings.Split(message, " ")) > 0 {
@@ -629,38 +1099,34 @@ func writingEmail(evt *event.Event, message string) {
 			fmt.Println(fileName)
 			err := deleteAttachment(fileName, writeTemp.pkID)
 			if err != nil {
-				matrixClient.SendText(roomID, "Couldn't delete attachment: "+err.Error())
+				sendText(roomID, "Couldn't delete attachment: "+err.Error())
 				return
 			}
 			_ = os.Remove(tempDir + fileName)
-			matrixClient.SendText(roomID, "Attachment deleted!")
+			sendText(roomID, "Attachment deleted!")
 
 		} else {
 			if evt.Content.AsMessage().MsgType == event.MsgText {
-				if len(strings.ReplaceAll(writeTemp.body, " ", "")) == 0 {
-					err = saveWritingtemp(string(roomID), "body", message+"\r\n")
-				} else {
-					err = saveWritingtemp(string(roomID), "body", writeTemp.body+message+"\r\n")
-				}
+				err = addDraftLine(writeTemp.pkID, evt.ID.String(), message)
 				if err != nil {
-					WriteLog(critical, "#54 saveWritingtemp: "+err.Error())
-					matrixClient.SendText(roomID, "An server-error occured Errorcode: #54")
+					WriteLog(critical, "#54 addDraftLine: "+err.Error())
+					sendText(roomID, "An server-error occured Errorcode: #54")
 					deleteWritingTemp(string(roomID))
 					return
 				}
 			} else if evt.Content.AsMessage().MsgType == event.MsgFile || evt.Content.AsMessage().MsgType == event.MsgImage {
-				if strings.HasPrefix(string(evt.Content.AsMessage().URL), "mxc://") {
-					reader, err := matrixClient.Download(id.MustParseContentURI(evt.Content.AsMessage().Body))
+				if content := evt.Content.AsMessage(); strings.HasPrefix(string(content.URL), "mxc://") || content.File != nil {
+					reader, err := downloadMedia(content)
 					if err != nil {
-						matrixClient.SendText(roomID, "Couldn't download File: "+err.Error())
+						sendText(roomID, "Couldn't download File: "+err.Error())
 					} else {
 						filename := strconv.Itoa(int(time.Now().Unix())) + "_" + evt.Content.AsMessage().Body
 						err := streamToTempFile(reader, filename)
 						if err != nil {
-							matrixClient.SendText(roomID, "Couldn't download file: "+err.Error())
+							sendText(roomID, "Couldn't download file: "+err.Error())
 						} else {
 							addEmailAttachment(writeTemp.pkID, filename)
-							matrixClient.SendText(roomID, "File "+filename+" attached!")
+							sendText(roomID, "File "+filename+" attached!")
 						}
 					}
 				}
@@ -670,6 +1136,286 @@ func writingEmail(evt *event.Event, message string) {
 	}
 }
 
+//editDraftLine replaces the line of a draft written in the edited event.
+//Returns false if the event didn't write a line
+func editDraftLine(evt *event.Event, edited id.EventID) bool {
+	writeTempID, err := getDraftOfLine(evt.RoomID.String(), edited.String())
+	if err != nil {
+		WriteLog(critical, "#138 getDraftOfLine: "+err.Error())
+		sendText(evt.RoomID, "An server-error occured Errorcode: #138")
+		return true
+	}
+	if writeTempID == -1 {
+		return false
+	}
+	content := evt.Content.AsMessage()
+	line := strings.TrimPrefix(content.Body, "* ")
+	if content.NewContent != nil {
+		line = content.NewContent.Body
+	}
+	if err = updateDraftLine(writeTempID, edited.String(), line); err != nil {
+		WriteLog(critical, "#139 updateDraftLine: "+err.Error())
+		sendText(evt.RoomID, "An server-error occured Errorcode: #139")
+	}
+	return true
+}
+
+//removeDraftLine removes the line of a draft written in the redacted event.
+//Returns false if the event didn't write a line
+func removeDraftLine(roomID id.RoomID, redacted id.EventID) bool {
+	writeTempID, err := getDraftOfLine(roomID.String(), redacted.String())
+	if err != nil {
+		WriteLog(logError, "#154 getDraftOfLine: "+err.Error())
+		return false
+	}
+	if writeTempID == -1 {
+		return false
+	}
+	if err = deleteDraftLine(writeTempID, redacted.String()); err != nil {
+		WriteLog(critical, "#140 deleteDraftLine: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #140")
+	}
+	return true
+}
+
+//getRepliedMail returns the bridged email an event replies to or nil if there is none
+func getRepliedMail(evt *event.Event) *bridgedMail {
+	roomID := evt.RoomID
+	replyTo := getInReplyTo(evt)
+	if len(replyTo) == 0 {
+		sendText(roomID, "You have to reply to a bridged email to use this command!")
+		return nil
+	}
+	//emails in portals are saved for their bridged room
+	mail, err := getBridgedMail(controlRoomID(roomID.String()), replyTo.String())
+	if err != nil {
+		WriteLog(critical, "#99 getBridgedMail: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #99")
+		return nil
+	}
+	if mail == nil {
+		sendText(roomID, "This message is not a bridged email!")
+		return nil
+	}
+	if mail.uid == 0 {
+		sendText(roomID, "This email isn't in your mailbox anymore!")
+		return nil
+	}
+	return mail
+}
+
+func move(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	mailbox := strings.TrimSpace(message)
+	if len(mailbox) == 0 {
+		sendText(roomID, "Usage: reply to an email with !move <mailbox>")
+		return
+	}
+	mail := getRepliedMail(evt)
+	if mail == nil {
+		return
+	}
+	mailboxes, err := getRoomMailboxes(controlRoomID(roomID.String()))
+	if err != nil {
+		WriteLog(logError, "#100 getRoomMailboxes: "+err.Error())
+		sendText(roomID, "Couldn't get your mailboxes: "+err.Error())
+		return
+	}
+	if !contains(mailboxes, mailbox) {
+		sendText(roomID, "The mailbox "+mailbox+" doesn't exist! Use !view mailboxes to see all your mailboxes")
+		return
+	}
+	moveRepliedMail(evt, mail, mailbox)
+}
+
+func archive(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	mail := getRepliedMail(evt)
+	if mail == nil {
+		return
+	}
+	archiveMailbox, err := getArchiveMailbox(controlRoomID(roomID.String()))
+	if err != nil {
+		sendText(roomID, "Couldn't find your archive: "+err.Error()+"\r\nUse !move <mailbox> instead")
+		return
+	}
+	moveRepliedMail(evt, mail, archiveMailbox)
+}
+
+func moveRepliedMail(evt *event.Event, mail *bridgedMail, mailbox string) {
+	if mail.mailbox == mailbox {
+		sendText(evt.RoomID, "The email is already in "+mailbox)
+		return
+	}
+	err := moveMail(controlRoomID(evt.RoomID.String()), mail, mailbox)
+	if err != nil {
+		WriteLog(logError, "#101 moveMail: "+err.Error())
+		sendText(evt.RoomID, "Couldn't move the email: "+err.Error())
+		return
+	}
+	sendReaction(evt.RoomID, evt.ID, "✅")
+}
+
+func search(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	accountRoom := controlRoomID(roomID.String())
+	account, err := getIMAPAccount(accountRoom)
+	if err != nil {
+		sendText(roomID, "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		return
+	}
+	if len(strings.TrimSpace(message)) == 0 {
+		sendText(roomID, "Usage: !search <query>\r\nExample: !search from:bob@host.com subject:\"my mail\" since:2022-01-31 unseen hello")
+		return
+	}
+	criteria, err := parseSearchQuery(message)
+	if err != nil {
+		sendText(roomID, "Invalid query: "+err.Error())
+		return
+	}
+	result, overview, err := searchMails(accountRoom, account.mailbox, criteria)
+	if err != nil {
+		WriteLog(logError, "#102 searchMails: "+err.Error())
+		sendText(roomID, "Couldn't search your mailbox: "+err.Error())
+		return
+	}
+	searchResultsMutex.Lock()
+	searchResults[roomID.String()] = result
+	searchResultsMutex.Unlock()
+	if len(overview) == 0 {
+		sendText(roomID, "No emails found")
+		return
+	}
+
+	text := "Found emails (newest first):\r\n"
+	for i, msg := range overview {
+		from := ""
+		if msg.Envelope != nil && len(msg.Envelope.From) > 0 {
+			from = msg.Envelope.From[0].Address()
+		}
+		subject, date := "", ""
+		if msg.Envelope != nil {
+			subject = msg.Envelope.Subject
+			date = msg.Envelope.Date.Format("2006-01-02 15:04")
+		}
+		text += strconv.Itoa(i+1) + ". " + date + " - " + from + " - " + subject + "\r\n"
+	}
+	text += "\r\nUse !show <number> to view an email"
+	sendText(roomID, text)
+}
+
+func show(evt *event.Event, message string) {
+	roomID := evt.RoomID
+	searchResultsMutex.Lock()
+	result, ok := searchResults[roomID.String()]
+	searchResultsMutex.Unlock()
+	if !ok {
+		sendText(roomID, "You have to !search first!")
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(message))
+	if err != nil || n < 1 || n > len(result.uids) {
+		sendText(roomID, "Usage: !show <number of the search result>")
+		return
+	}
+	accountRoom := controlRoomID(roomID.String())
+	account, err := getIMAPAccount(accountRoom)
+	if err != nil {
+		WriteLog(critical, "#103 getIMAPAccount: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #103")
+		return
+	}
+	msg, section, err := fetchSearchResult(accountRoom, result, result.uids[n-1])
+	if err != nil {
+		WriteLog(logError, "#104 fetchSearchResult: "+err.Error())
+		sendText(roomID, "Couldn't fetch the email: "+err.Error())
+		return
+	}
+	account.mailbox = result.mailbox
+	showMail(msg, section, *account, result.uidValidity, roomID)
+}
+
+//replyToMail answers a bridged email with the text of a matrix reply
+func replyToMail(evt *event.Event, message string, mail *bridgedMail) {
+	roomID := evt.RoomID
+	//replies in portal rooms are sent with the account of their bridged room
+	accountRoom := controlRoomID(roomID.String())
+	_, smtpAccID, err := getRoomAccounts(accountRoom)
+	if err != nil {
+		WriteLog(critical, "#83 getRoomAccounts: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #83")
+		return
+	}
+	if smtpAccID == -1 {
+		sendText(roomID, "You have to setup an smtp account to reply to emails. Type !help or !login for more information")
+		return
+	}
+	if len(mail.sender) == 0 {
+		sendText(roomID, "Can't reply: the email has no sender address")
+		return
+	}
+	account, err := getSMTPAccount(accountRoom)
+	if err != nil {
+		WriteLog(critical, "#84 getSMTPAccount: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #84")
+		return
+	}
+
+	subject := mail.subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	messageID := generateMessageID(account.username)
+	references := strings.Fields(mail.references)
+	m := gomail.NewMessage()
+	m.SetHeader("From", account.username)
+	m.SetHeader("To", mail.sender)
+	m.SetHeader("Subject", subject)
+	m.SetHeader("Message-ID", "<"+messageID+">")
+	if len(mail.messageID) > 0 {
+		references = append(references, mail.messageID)
+		var referenceHeader []string
+		for _, reference := range references {
+			referenceHeader = append(referenceHeader, "<"+reference+">")
+		}
+		m.SetHeader("In-Reply-To", "<"+mail.messageID+">")
+		m.SetHeader("References", strings.Join(referenceHeader, " "))
+	}
+	setMailBody(m, message, viper.GetBool("markdownEnabledByDefault"))
+
+	//the outbox reports the delivery in the room of the account
+	if err := queueMail(accountRoom, m, subject, time.Time{}); err != nil {
+		WriteLog(logError, "#85 queueMail: "+err.Error())
+		sendText(roomID, "Couldn't send reply: "+err.Error())
+		return
+	}
+
+	resp, err := sendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType:   event.MsgNotice,
+		Body:      "Reply to " + mail.sender + " queued for sending",
+		RelatesTo: threadRelation(id.EventID(mail.threadRoot)),
+	})
+	if err != nil {
+		return
+	}
+	//remember the reply, so that answers to it end up in the same thread
+	err = saveBridgedMail(bridgedMail{
+		roomPKID:          mail.roomPKID,
+		eventID:           resp.EventID.String(),
+		messageID:         messageID,
+		subject:           subject,
+		sender:            mail.sender,
+		references:        strings.Join(references, " "),
+		threadRoot:        mail.threadRoot,
+		normalizedSubject: mail.normalizedSubject,
+		portal:            mail.portal,
+	})
+	if err != nil {
+		WriteLog(logError, "#87 saveBridgedMail: "+err.Error())
+	}
+}
+
 func runCommand(message string, evt *event.Event) {
 	if strings.HasPrefix(message, "!") {
 		firstWord, restOfMesage, _ := strings.Cut(message, " ")
@@ -677,7 +1423,7 @@ func runCommand(message string, evt *event.Event) {
 		if ok {
 			commandHandler(evt, restOfMesage)
 		} else {
-			matrixClient.SendText(evt.RoomID, "command not found!")
+			sendText(evt.RoomID, "command not found!")
 		}
 	}
 }
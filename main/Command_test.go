@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestAddRecipients(t *testing.T) {
+	tests := []struct {
+		list      []string
+		addresses string
+		want      []string
+	}{
+		{nil, "a@b.de", []string{"a@b.de"}},
+		{nil, "a@b.de,A@b.de, c@d.com,xx", []string{"a@b.de", "c@d.com"}},
+		{[]string{"a@b.de"}, " C@d.com , a@B.de", []string{"a@b.de", "C@d.com"}},
+		{[]string{"a@b.de"}, "", []string{"a@b.de"}},
+		//invalid addresses are skipped
+		{nil, "nobody,no@dot,a.b.c,@b.de", nil},
+	}
+	for _, test := range tests {
+		got := addRecipients(test.list, test.addresses)
+		if len(got) != len(test.want) || (len(got) > 0 && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("addRecipients(%q, %q) = %q, want %q", test.list, test.addresses, got, test.want)
+		}
+	}
+}
+
+func TestRecipientSummary(t *testing.T) {
+	writeTemp := &emailTemp{receiver: "to@example.org"}
+	if got, want := recipientSummary(writeTemp), "To: to@example.org"; got != want {
+		t.Errorf("recipientSummary = %q, want %q", got, want)
+	}
+	writeTemp.cc = "cc1@example.org,cc2@example.org"
+	writeTemp.bcc = "bcc@example.org"
+	if got, want := recipientSummary(writeTemp), "To: to@example.org\r\nCc: cc1@example.org, cc2@example.org\r\nBcc: bcc@example.org"; got != want {
+		t.Errorf("recipientSummary = %q, want %q", got, want)
+	}
+}
+
+func TestSetCopyRecipients(t *testing.T) {
+	setupTestDB(t)
+	_, sentMessages := setupTestMatrix(t, http.NewServeMux())
+	if err := newWritingTemp(testRoom.String(), "to@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	saveWritingtemp(testRoom.String(), "markdown", "1")
+	writeTemp, err := getWritingTemp(testRoom.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCopyRecipients(testRoom, writeTemp, "cc", "cc1@example.org cc2@example.org")
+	setCopyRecipients(testRoom, writeTemp, "cc", "CC1@example.org,cc3@example.org")
+	setCopyRecipients(testRoom, writeTemp, "bcc", "bcc@example.org")
+	//nothing new to add
+	setCopyRecipients(testRoom, writeTemp, "bcc", "bcc@example.org")
+
+	stored, err := getWritingTemp(testRoom.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.cc != "cc1@example.org,cc2@example.org,cc3@example.org" || stored.bcc != "bcc@example.org" {
+		t.Errorf("stored cc = %q, bcc = %q", stored.cc, stored.bcc)
+	}
+	if *stored != *writeTemp {
+		t.Errorf("stored draft %+v differs from %+v", *stored, *writeTemp)
+	}
+	messages := sentMessages()
+	if len(messages) != 4 || messages[2] != "To: to@example.org\r\nCc: cc1@example.org, cc2@example.org, cc3@example.org\r\nBcc: bcc@example.org" || messages[3] != "Usage: !bcc <emailaddress(es)> or !bcc clear" {
+		t.Errorf("sent messages = %q", messages)
+	}
+
+	setCopyRecipients(testRoom, writeTemp, "cc", "clear")
+	if stored, _ = getWritingTemp(testRoom.String()); stored.cc != "" || stored.bcc != "bcc@example.org" {
+		t.Errorf("after clear: cc = %q, bcc = %q", stored.cc, stored.bcc)
+	}
+}
+
+func TestEditDraftLine(t *testing.T) {
+	setupTestDB(t)
+	setupTestMatrix(t, http.NewServeMux())
+	if err := newWritingTemp(testRoom.String(), "a@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	addDraftLine(1, "$line", "helo")
+
+	tests := []struct {
+		name    string
+		content string
+		edited  bool
+		want    string
+	}{
+		//clients without m.new_content only send the fallback body
+		{"fallback only", `{"msgtype":"m.text","body":"* hello","m.relates_to":{"rel_type":"m.replace","event_id":"$line"}}`, true, "hello\r\n"},
+		{"new content", `{"msgtype":"m.text","body":"* fallback","m.new_content":{"msgtype":"m.text","body":"hello world"},"m.relates_to":{"rel_type":"m.replace","event_id":"$line"}}`, true, "hello world\r\n"},
+		{"unknown line", `{"msgtype":"m.text","body":"* other","m.relates_to":{"rel_type":"m.replace","event_id":"$other"}}`, false, "hello world\r\n"},
+	}
+	for _, test := range tests {
+		evt := &event.Event{Type: event.EventMessage, RoomID: testRoom}
+		if err := json.Unmarshal([]byte(test.content), &evt.Content); err != nil {
+			t.Fatal(err)
+		}
+		if err := evt.Content.ParseRaw(evt.Type); err != nil {
+			t.Fatal(err)
+		}
+		if edited := editDraftLine(evt, getReplacedEvent(evt)); edited != test.edited {
+			t.Errorf("%s: editDraftLine = %v, want %v", test.name, edited, test.edited)
+		}
+		writeTemp, err := getWritingTemp(testRoom.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if writeTemp.body != test.want {
+			t.Errorf("%s: body = %q, want %q", test.name, writeTemp.body, test.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+//prefix of encrypted values in the database. Values without this prefix are legacy base64 passwords
+const encryptedPrefix = "enc:"
+
+const masterKeyEnv = "BRIDGE_MASTER_KEY"
+
+var masterKey []byte
+
+//initMasterKey loads the key used to encrypt stored credentials from the environment or the key file.
+//The key file has to be outside of the data directory, otherwise a copy of data.db would come with its key.
+//A new key file gets created if it doesn't exist and nothing was encrypted yet
+func initMasterKey() error {
+	encoded := os.Getenv(masterKeyEnv)
+	if len(encoded) == 0 {
+		keyFile := viper.GetString("masterKeyFile")
+		if len(keyFile) == 0 {
+			return errors.New("no master key configured. Set " + masterKeyEnv + " or masterkeyfile in the cfg.json to a file outside of the data directory")
+		}
+		inDataDir, err := isInDataDir(keyFile)
+		if err != nil {
+			return err
+		}
+		if inDataDir {
+			return errors.New("the master key file " + keyFile + " is inside the data directory. Move it to another directory or set " + masterKeyEnv)
+		}
+
+		content, err := ioutil.ReadFile(keyFile)
+		if os.IsNotExist(err) {
+			return createMasterKey(keyFile)
+		} else if err != nil {
+			return err
+		}
+		encoded = string(content)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return errors.New("invalid master key: " + err.Error())
+	}
+	if len(key) != 32 {
+		return errors.New("invalid master key: it has to be 32 bytes long (base64 encoded)")
+	}
+	masterKey = key
+	return nil
+}
+
+//createMasterKey generates a new master key and saves it in keyFile
+func createMasterKey(keyFile string) error {
+	hasEncrypted, err := hasEncryptedCredentials()
+	if err != nil {
+		return err
+	}
+	if hasEncrypted {
+		return errors.New("data.db contains encrypted passwords but " + keyFile + " doesn't exist. Restore it or set " + masterKeyEnv)
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return err
+	}
+	WriteLog(info, "created new master key in "+keyFile+". Keep a backup of it, without it the stored passwords can't be decrypted")
+	masterKey = key
+	return nil
+}
+
+//isInDataDir returns true if path is inside the directory containing data.db
+func isInDataDir(path string) (bool, error) {
+	dataDir, err := filepath.Abs(filepath.Dir(dirPrefix + "data.db"))
+	if err != nil {
+		return false, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(dataDir, absPath)
+	if err != nil {
+		//no relative path means they are on different volumes
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+func newGCM() (cipher.AEAD, error) {
+	if masterKey == nil {
+		return nil, errors.New("master key not loaded")
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//encryptSecret encrypts a password or token with AES-256-GCM
+func encryptSecret(plain string) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+//decryptSecret decrypts a value encrypted by encryptSecret. Legacy values get base64 decoded
+func decryptSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		plain, err := base64.StdEncoding.DecodeString(stored)
+		return string(plain), err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted value too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("can't decrypt value, wrong master key?")
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestEncryptSecret(t *testing.T) {
+	masterKey = bytes.Repeat([]byte{1}, 32)
+	defer func() { masterKey = nil }()
+
+	for _, plain := range []string{"", "password", "pässwörd with spaces"} {
+		encrypted, err := encryptSecret(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(encrypted, encryptedPrefix) || (len(plain) > 0 && strings.Contains(encrypted, plain)) {
+			t.Errorf("encryptSecret(%q) = %q", plain, encrypted)
+		}
+		decrypted, err := decryptSecret(encrypted)
+		if err != nil || decrypted != plain {
+			t.Errorf("decryptSecret(encryptSecret(%q)) = %q, %v", plain, decrypted, err)
+		}
+	}
+
+	//a new nonce is used for every value
+	first, _ := encryptSecret("password")
+	second, _ := encryptSecret("password")
+	if first == second {
+		t.Errorf("encrypting the same value twice gave the same result")
+	}
+
+	encrypted, _ := encryptSecret("password")
+	masterKey = bytes.Repeat([]byte{2}, 32)
+	if _, err := decryptSecret(encrypted); err == nil {
+		t.Errorf("decrypting with the wrong key succeeded")
+	}
+}
+
+func TestDecryptLegacySecret(t *testing.T) {
+	//values stored before the encryption was added are only base64 encoded and can be read without a key
+	masterKey = nil
+	decrypted, err := decryptSecret(base64.StdEncoding.EncodeToString([]byte("password")))
+	if err != nil || decrypted != "password" {
+		t.Errorf("decryptSecret(legacy) = %q, %v, want password", decrypted, err)
+	}
+
+	if _, err = decryptSecret("not base64!"); err == nil {
+		t.Errorf("invalid legacy value accepted")
+	}
+	if _, err = decryptSecret(encryptedPrefix + "AAAA"); err == nil {
+		t.Errorf("encrypted value decrypted without a master key")
+	}
+}
+
+func TestInitMasterKey(t *testing.T) {
+	setupTestDB(t)
+	dataDir := t.TempDir()
+	keyDir := t.TempDir()
+	oldPrefix := dirPrefix
+	dirPrefix = dataDir + "/"
+	defer func() { dirPrefix = oldPrefix }()
+	validKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+
+	tests := []struct {
+		name    string
+		env     string
+		keyFile string
+		wantErr string
+	}{
+		{"key from environment", validKey, "", ""},
+		{"invalid key in environment", "not a key", "", "invalid master key"},
+		{"nothing configured", "", "", "no master key configured"},
+		{"key file next to data.db", "", filepath.Join(dataDir, "master.key"), "inside the data directory"},
+		{"key file below the data directory", "", filepath.Join(dataDir, "keys", "master.key"), "inside the data directory"},
+		{"key file outside the data directory", "", filepath.Join(keyDir, "master.key"), ""},
+	}
+	for _, test := range tests {
+		t.Setenv(masterKeyEnv, test.env)
+		viper.Set("masterKeyFile", test.keyFile)
+		masterKey = nil
+		err := initMasterKey()
+		if len(test.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: initMasterKey() = %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || len(masterKey) != 32 {
+			t.Errorf("%s: initMasterKey() = %v with a key of %d bytes", test.name, err, len(masterKey))
+		}
+	}
+
+	//the created key file is private and gets loaded again on the next start
+	keyFile := filepath.Join(keyDir, "master.key")
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file has mode %v, want 0600", info.Mode().Perm())
+	}
+	created := masterKey
+	masterKey = nil
+	if err = initMasterKey(); err != nil || !bytes.Equal(masterKey, created) {
+		t.Errorf("reloading the key file = %v, key changed: %v", err, !bytes.Equal(masterKey, created))
+	}
+
+	//a lost key file must not be replaced while encrypted passwords exist
+	encrypted, _ := encryptSecret("password")
+	if _, err = db.Exec("INSERT INTO imapAccounts (host, username, password) VALUES ('host', 'user', ?)", encrypted); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(keyFile)
+	if err = initMasterKey(); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("missing key file with encrypted passwords: initMasterKey() = %v", err)
+	}
+	viper.Set("masterKeyFile", "")
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -19,34 +21,100 @@ type emailTemp struct {
 	pkID                            int
 	roomID, receiver, subject, body string
 	markdown                        bool
+	cc, bcc                         string
 }
 
 type imapAccountount struct {
 	host, username, password, roomID, mailbox string
 	ignoreSSL                                 bool
-	roomPKID, mailCheckInterval               int
+	roomPKID, mailCheckInterval, maxCatchUp   int
 	silence                                   bool
+	security, authMethod                      string
+	oauthToken                                int
 }
 
 type smtpAccount struct {
 	host, username, password, roomID string
 	ignoreSSL                        bool
 	roomPKID, port, pk               int
+	security, authMethod             string
+	oauthToken                       int
 }
 
+type bridgedMail struct {
+	roomPKID                                                 int
+	eventID, messageID, subject, sender, references, mailbox string
+	uidValidity, uid                                         uint32
+	threadRoot, normalizedSubject                            string
+	portal                                                   int
+}
+
+//portal is a room created for a correspondent or conversation of a bridged room
+type portal struct {
+	pk, roomPKID          int
+	roomID, controlRoomID string
+	mode, correspondent   string
+}
+
+//outboxMail is a serialized email waiting to be sent
+type outboxMail struct {
+	pk                                  int
+	roomID, sender, recipients, subject string
+	message                             []byte
+	status                              string
+	attempts                            int
+	nextAttempt                         int64
+	lastError                           string
+}
+
+//states of emails in the outbox
+const (
+	outboxQueued    = "queued"
+	outboxPaused    = "paused"
+	outboxFailed    = "failed"
+	outboxScheduled = "scheduled"
+)
+
+const (
+	redactActionTrash  = "trash"
+	redactActionDelete = "delete"
+	redactActionOff    = "off"
+)
+
+//modes for creating portal rooms
+const (
+	portalModeOff           = "off"
+	portalModeCorrespondent = "correspondent"
+	portalModeConversation  = "conversation"
+)
+
+//connection security modes of mail accounts
+const (
+	securityTLS      = "tls"
+	securityStartTLS = "starttls"
+	securityPlain    = "plain"
+	//smtp accounts added before the security mode existed use STARTTLS only if the server offers it
+	securityOpportunistic = "opportunistic"
+)
+
 type dbChange struct {
 	version int
 	changes string
 }
 
 var tables = []table{
-	{"mail", "mail TEXT, room INTEGER"},
-	{"rooms", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, imapAccount INTEGER DEFAULT -1, smtpAccount INTEGER DEFAULT -1, mailCheckInterval INTEGER, isHTMLenabled INTEGER"},
-	{"imapAccounts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, username TEXT, password TEXT, ignoreSSL INTEGER, mailbox TEXT"},
-	{"smtpAccounts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, port int, username TEXT, password TEXT, ignoreSSL INTEGER"},
-	{"emailWritingTemp", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, receiver TEXT, subject TEXT DEFAULT ' ', body TEXT DEFAULT ' ', markdown INTEGER"},
+	{"mailboxState", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, room INTEGER, mailbox TEXT, uidValidity INTEGER, lastUID INTEGER"},
+	{"rooms", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, imapAccount INTEGER DEFAULT -1, smtpAccount INTEGER DEFAULT -1, mailCheckInterval INTEGER, isHTMLenabled INTEGER, maxCatchUp INTEGER, maxAttachmentSize INTEGER, syncReadState INTEGER DEFAULT 0, redactAction TEXT DEFAULT 'off', portalMode TEXT DEFAULT 'off'"},
+	{"imapAccounts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, username TEXT, password TEXT, ignoreSSL INTEGER, mailbox TEXT, security TEXT DEFAULT 'tls', authMethod TEXT DEFAULT 'password', oauthToken INTEGER DEFAULT -1"},
+	{"smtpAccounts", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, port int, username TEXT, password TEXT, ignoreSSL INTEGER, security TEXT DEFAULT 'starttls', authMethod TEXT DEFAULT 'password', oauthToken INTEGER DEFAULT -1"},
+	{"oauthTokens", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, provider TEXT, username TEXT, refreshToken TEXT, accessToken TEXT, expiry INTEGER"},
+	{"emailWritingTemp", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, receiver TEXT, subject TEXT DEFAULT ' ', body TEXT DEFAULT ' ', markdown INTEGER, cc TEXT DEFAULT '', bcc TEXT DEFAULT '', active INTEGER DEFAULT 1"},
+	{"bridgedMails", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, room INTEGER, eventID TEXT, messageID TEXT, subject TEXT, sender TEXT, mailReferences TEXT, mailbox TEXT, uidValidity INTEGER, uid INTEGER, threadRoot TEXT DEFAULT '', normalizedSubject TEXT DEFAULT '', seen INTEGER DEFAULT 0, portal INTEGER DEFAULT -1"},
+	{"portals", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, room INTEGER, portalRoomID TEXT, mode TEXT, correspondent TEXT"},
 	{"version", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, version INTEGER"},
 	{"emailAttachments", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, writeTempID INTEGER, fileName TEXT"},
+	{"draftLines", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, writeTempID INTEGER, eventID TEXT, line TEXT"},
+	{"outbox", "pk_id INTEGER PRIMARY KEY AUTOINCREMENT, roomID TEXT, sender TEXT, recipients TEXT, subject TEXT, message BLOB, status TEXT DEFAULT 'queued', attempts INTEGER DEFAULT 0, nextAttempt INTEGER DEFAULT 0, lastError TEXT DEFAULT ''"},
 }
 
 func handleDBVersion() {
@@ -104,6 +172,30 @@ var dbChanges = []dbChange{
 	{2, "ALTER TABLE rooms ADD isHTMLenabled INTEGER"},
 	{2, "UPDATE rooms SET isHTMLenabled=0"},
 	{7, "CREATE TABLE `blocklist` (`pkID` INTEGER PRIMARY KEY AUTOINCREMENT, `imapAccount` INTEGER, `address` INTEGER);"},
+	{8, "DROP TABLE IF EXISTS mail"},
+	{9, "ALTER TABLE rooms ADD maxCatchUp INTEGER"},
+	{9, "UPDATE rooms SET maxCatchUp=50"},
+	{10, "ALTER TABLE rooms ADD maxAttachmentSize INTEGER"},
+	{10, "UPDATE rooms SET maxAttachmentSize=10"},
+	{11, "ALTER TABLE bridgedMails ADD threadRoot TEXT DEFAULT ''"},
+	{11, "ALTER TABLE bridgedMails ADD normalizedSubject TEXT DEFAULT ''"},
+	{12, "ALTER TABLE rooms ADD syncReadState INTEGER DEFAULT 0"},
+	{12, "ALTER TABLE bridgedMails ADD seen INTEGER DEFAULT 0"},
+	{13, "ALTER TABLE rooms ADD redactAction TEXT DEFAULT 'off'"},
+	{14, "ALTER TABLE imapAccounts ADD security TEXT DEFAULT 'tls'"},
+	{15, "ALTER TABLE smtpAccounts ADD security TEXT DEFAULT 'starttls'"},
+	{15, "UPDATE smtpAccounts SET security='tls' WHERE port=465"},
+	{15, "UPDATE smtpAccounts SET security='opportunistic' WHERE port!=465"},
+	{16, "ALTER TABLE imapAccounts ADD authMethod TEXT DEFAULT 'password'"},
+	{16, "ALTER TABLE imapAccounts ADD oauthToken INTEGER DEFAULT -1"},
+	{16, "ALTER TABLE smtpAccounts ADD authMethod TEXT DEFAULT 'password'"},
+	{16, "ALTER TABLE smtpAccounts ADD oauthToken INTEGER DEFAULT -1"},
+	{17, "ALTER TABLE rooms ADD portalMode TEXT DEFAULT 'off'"},
+	{17, "ALTER TABLE bridgedMails ADD portal INTEGER DEFAULT -1"},
+	{18, "ALTER TABLE emailWritingTemp ADD cc TEXT DEFAULT ''"},
+	{18, "ALTER TABLE emailWritingTemp ADD bcc TEXT DEFAULT ''"},
+	{19, "ALTER TABLE emailWritingTemp ADD active INTEGER DEFAULT 1"},
+	{20, "INSERT INTO draftLines (writeTempID, eventID, line) SELECT pk_id, '', RTRIM(body, char(13, 10)) FROM emailWritingTemp WHERE TRIM(body) != ''"},
 }
 
 func startDBupgrader(oldVers int) {
@@ -152,72 +244,200 @@ func dbCountVersion() (int, error) {
 	return count, nil
 }
 
-func insertEmail(email string, roomPK int) error {
-	if val, err := dbContainsMail(email, roomPK); val && err == nil {
-		return nil
+//getMailboxState returns the UIDVALIDITY and the last bridged UID of a mailbox
+func getMailboxState(roomPK int, mailbox string) (uidValidity, lastUID uint32, found bool, err error) {
+	stmt, err := db.Prepare("SELECT uidValidity, lastUID FROM mailboxState WHERE room=? AND mailbox=?")
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(roomPK, mailbox).Scan(&uidValidity, &lastUID)
+	if err == sql.ErrNoRows {
+		return 0, 0, false, nil
 	} else if err != nil {
+		return 0, 0, false, err
+	}
+	return uidValidity, lastUID, true, nil
+}
+
+func saveMailboxState(roomPK int, mailbox string, uidValidity, lastUID uint32) error {
+	stmt, err := db.Prepare("DELETE FROM mailboxState WHERE room=? AND mailbox=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(roomPK, mailbox)
+	if err != nil {
+		return err
+	}
+	stmt, err = db.Prepare("INSERT INTO mailboxState (room, mailbox, uidValidity, lastUID) VALUES(?,?,?,?)")
+	if err != nil {
 		return err
 	}
+	_, err = stmt.Exec(roomPK, mailbox, uidValidity, lastUID)
+	return err
+}
 
-	stmt, err := db.Prepare("INSERT OR IGNORE INTO mail(mail, room) values(?,?)")
-	checkErr(err)
+func saveBridgedMail(mail bridgedMail) error {
+	stmt, err := db.Prepare("INSERT INTO bridgedMails (room, eventID, messageID, subject, sender, mailReferences, mailbox, uidValidity, uid, threadRoot, normalizedSubject, portal) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(mail.roomPKID, mail.eventID, mail.messageID, mail.subject, mail.sender, mail.references, mail.mailbox, mail.uidValidity, mail.uid, mail.threadRoot, mail.normalizedSubject, mail.portal)
+	return err
+}
 
-	_, err = stmt.Exec(email, roomPK)
-	checkErr(err)
-	return nil
+//findThreadRoot returns the thread root of the conversation an email belongs to within the room or portal (-1 for the room itself).
+//Emails are matched by their referenced message IDs first and by their normalized subject second
+func findThreadRoot(roomPK, portalPK int, messageIDs []string, normalizedSubject string) (string, error) {
+	var threadRoot string
+	for _, messageID := range messageIDs {
+		err := db.QueryRow("SELECT threadRoot FROM bridgedMails WHERE room=? AND portal=? AND messageID=? AND threadRoot!='' ORDER BY pk_id DESC LIMIT 1", roomPK, portalPK, messageID).Scan(&threadRoot)
+		if err == nil {
+			return threadRoot, nil
+		} else if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+	if len(normalizedSubject) == 0 {
+		return "", nil
+	}
+	err := db.QueryRow("SELECT threadRoot FROM bridgedMails WHERE room=? AND portal=? AND normalizedSubject=? AND threadRoot!='' ORDER BY pk_id DESC LIMIT 1", roomPK, portalPK, normalizedSubject).Scan(&threadRoot)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return threadRoot, err
 }
 
-func dbContainsMail(mail string, roomPK int) (bool, error) {
-	stmt, err := db.Prepare("SELECT COUNT(mail) FROM mail WHERE mail=? AND room=?")
+//getBridgedMail returns the email bridged as the given event or nil if the event isn't a bridged email
+func getBridgedMail(roomID, eventID string) (*bridgedMail, error) {
+	stmt, err := db.Prepare("SELECT " + bridgedMailColumns + " FROM bridgedMails WHERE eventID=? AND room=(SELECT pk_id FROM rooms WHERE roomID=?)")
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer stmt.Close()
-	var count int
-	err = stmt.QueryRow(mail, roomPK).Scan(&count)
+	return scanBridgedMail(stmt.QueryRow(eventID, roomID))
+}
+
+//forgetMailUID unlinks all events of an email from its imap message, after the message was moved or deleted
+func forgetMailUID(mail *bridgedMail) error {
+	stmt, err := db.Prepare("UPDATE bridgedMails SET uid=0 WHERE room=? AND mailbox=? AND uidValidity=? AND uid=?")
 	if err != nil {
-		return false, err
+		return err
 	}
-	return (count > 0), nil
+	_, err = stmt.Exec(mail.roomPKID, mail.mailbox, mail.uidValidity, mail.uid)
+	return err
+}
+
+const bridgedMailColumns = "room, eventID, messageID, subject, sender, mailReferences, mailbox, uidValidity, uid, threadRoot, normalizedSubject, IFNULL(portal, -1)"
+
+func scanBridgedMail(row *sql.Row) (*bridgedMail, error) {
+	var mail bridgedMail
+	err := row.Scan(&mail.roomPKID, &mail.eventID, &mail.messageID, &mail.subject, &mail.sender, &mail.references, &mail.mailbox, &mail.uidValidity, &mail.uid, &mail.threadRoot, &mail.normalizedSubject, &mail.portal)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &mail, nil
+}
+
+//mailsUpToEvent selects the bridged emails of a room up to and including the one bridged as the given event.
+//Only emails posted into the same matrix room (the control room or one portal) as that event are selected
+const mailsUpToEvent = "room=(SELECT pk_id FROM rooms WHERE roomID=?) AND EXISTS (SELECT 1 FROM bridgedMails AS receipted WHERE receipted.eventID=? AND receipted.room=bridgedMails.room AND IFNULL(receipted.portal, -1)=IFNULL(bridgedMails.portal, -1) AND receipted.pk_id>=bridgedMails.pk_id)"
+
+//getUnseenMails returns the bridged emails of a room which aren't marked as seen yet, up to and including the one bridged as eventID
+func getUnseenMails(roomID, eventID string) ([]bridgedMail, error) {
+	rows, err := db.Query("SELECT mailbox, uidValidity, uid FROM bridgedMails WHERE seen=0 AND uid!=0 AND "+mailsUpToEvent, roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var mails []bridgedMail
+	for rows.Next() {
+		var mail bridgedMail
+		if err = rows.Scan(&mail.mailbox, &mail.uidValidity, &mail.uid); err != nil {
+			return nil, err
+		}
+		mails = append(mails, mail)
+	}
+	return mails, rows.Err()
+}
+
+//setMailsSeen marks the bridged emails of a room up to and including the one bridged as eventID as seen
+func setMailsSeen(roomID, eventID string) error {
+	_, err := db.Exec("UPDATE bridgedMails SET seen=1 WHERE "+mailsUpToEvent, roomID, eventID)
+	return err
 }
 
-func deleteAttachments(roomID string) {
-	stmt, err := db.Prepare("SELECT pk_id FROM emailWritingTemp WHERE roomID=?")
+const writingTempColumns = "pk_id, roomID, receiver, subject, body, IFNULL(markdown,0), IFNULL(cc,''), IFNULL(bcc,'')"
+
+func deleteAttachments(writeTempID int) {
+	attachments, err := getAttachments(writeTempID)
 	if err == nil {
-		var pkid int
-		err = stmt.QueryRow(roomID).Scan(&pkid)
-		if err == nil {
-			attachments, err := getAttachments(pkid)
-			if err == nil {
-				for _, i := range attachments {
-					deleteTempFile(i)
-				}
-			}
-			stmt, err = db.Prepare("DELETE FROM emailAttachments WHERE writeTempID=?")
-			if err == nil {
-				stmt.Exec(pkid)
-			}
+		for _, i := range attachments {
+			deleteTempFile(i)
 		}
 	}
+	stmt, err := db.Prepare("DELETE FROM emailAttachments WHERE writeTempID=?")
+	if err == nil {
+		stmt.Exec(writeTempID)
+	}
+}
+
+//deleteDraftData deletes the attachments and lines of a draft
+func deleteDraftData(writeTempID int) {
+	deleteAttachments(writeTempID)
+	db.Exec("DELETE FROM draftLines WHERE writeTempID=?", writeTempID)
 }
 
 func deleteWritingTemp(roomID string) error {
-	deleteAttachments(roomID)
-	stmt, err := db.Prepare("DELETE FROM emailWritingTemp WHERE roomID=?")
+	writeTemp, err := getWritingTemp(roomID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	deleteDraftData(writeTemp.pkID)
+	stmt, err := db.Prepare("DELETE FROM emailWritingTemp WHERE pk_id=?")
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(roomID)
+	_, err = stmt.Exec(writeTemp.pkID)
 	return err
 }
 
-func deleteAllWritingTemps() error {
-	_, err := db.Exec("DELETE FROM emailWritingTemp")
+//deleteDraft deletes a draft of a room, false means it doesn't exist
+func deleteDraft(roomID string, pkID int) (bool, error) {
+	drafts, err := getDrafts(roomID)
+	if err != nil {
+		return false, err
+	}
+	for _, draft := range drafts {
+		if draft.pkID == pkID {
+			deleteDraftData(pkID)
+			_, err = db.Exec("DELETE FROM emailWritingTemp WHERE pk_id=?", pkID)
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+//deleteDrafts deletes all drafts of a room
+func deleteDrafts(roomID string) error {
+	drafts, err := getDrafts(roomID)
+	if err != nil {
+		return err
+	}
+	for _, draft := range drafts {
+		deleteDraftData(draft.pkID)
+	}
+	_, err = db.Exec("DELETE FROM emailWritingTemp WHERE roomID=?", roomID)
 	return err
 }
 
+//newWritingTemp creates a new draft the user is writing. Other drafts of the room have to be paused before
 func newWritingTemp(roomID, receiver string) error {
-	stmt, err := db.Prepare("INSERT INTO emailWritingTemp (roomID, receiver) VALUES(?,?)")
+	stmt, err := db.Prepare("INSERT INTO emailWritingTemp (roomID, receiver, active) VALUES(?,?,1)")
 	if err != nil {
 		return err
 	}
@@ -225,6 +445,84 @@ func newWritingTemp(roomID, receiver string) error {
 	return err
 }
 
+//pauseWritingTemp keeps the email the user is writing as draft
+func pauseWritingTemp(roomID string) error {
+	_, err := db.Exec("UPDATE emailWritingTemp SET active=0 WHERE roomID=?", roomID)
+	return err
+}
+
+//resumeDraft continues writing a draft, false means it doesn't exist
+func resumeDraft(roomID string, pkID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM emailWritingTemp WHERE roomID=? AND pk_id=?", roomID, pkID).Scan(&count)
+	if err != nil || count == 0 {
+		return false, err
+	}
+	if err = pauseWritingTemp(roomID); err != nil {
+		return false, err
+	}
+	_, err = db.Exec("UPDATE emailWritingTemp SET active=1 WHERE pk_id=?", pkID)
+	return err == nil, err
+}
+
+//addDraftLine appends a line written in the event to the body of a draft
+func addDraftLine(writeTempID int, eventID, line string) error {
+	_, err := db.Exec("INSERT INTO draftLines (writeTempID, eventID, line) VALUES(?,?,?)", writeTempID, eventID, line)
+	if err != nil {
+		return err
+	}
+	return rebuildDraftBody(writeTempID)
+}
+
+//getDraftOfLine returns the draft the event wrote a line into, -1 if there is none
+func getDraftOfLine(roomID, eventID string) (int, error) {
+	var writeTempID int
+	err := db.QueryRow("SELECT draftLines.writeTempID FROM draftLines JOIN emailWritingTemp ON (emailWritingTemp.pk_id = draftLines.writeTempID) WHERE emailWritingTemp.roomID=? AND draftLines.eventID=?", roomID, eventID).Scan(&writeTempID)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	return writeTempID, err
+}
+
+//updateDraftLine replaces the line written in the event
+func updateDraftLine(writeTempID int, eventID, line string) error {
+	_, err := db.Exec("UPDATE draftLines SET line=? WHERE writeTempID=? AND eventID=?", line, writeTempID, eventID)
+	if err != nil {
+		return err
+	}
+	return rebuildDraftBody(writeTempID)
+}
+
+//deleteDraftLine removes the line written in the event
+func deleteDraftLine(writeTempID int, eventID string) error {
+	_, err := db.Exec("DELETE FROM draftLines WHERE writeTempID=? AND eventID=?", writeTempID, eventID)
+	if err != nil {
+		return err
+	}
+	return rebuildDraftBody(writeTempID)
+}
+
+//rebuildDraftBody saves the lines of a draft as its body
+func rebuildDraftBody(writeTempID int) error {
+	rows, err := db.Query("SELECT line FROM draftLines WHERE writeTempID=? ORDER BY pk_id", writeTempID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var body, line string
+	for rows.Next() {
+		if err = rows.Scan(&line); err != nil {
+			return err
+		}
+		body += line + "\r\n"
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE emailWritingTemp SET body=? WHERE pk_id=?", body, writeTempID)
+	return err
+}
+
 func addEmailAttachment(emailid int, filename string) error {
 	stmt, err := db.Prepare("INSERT INTO emailAttachments (writeTempID, fileName) VALUES(?,?)")
 	if err != nil {
@@ -248,6 +546,7 @@ func getAttachments(writingTempID int) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var attachments []string
 	var name string
@@ -258,27 +557,51 @@ func getAttachments(writingTempID int) ([]string, error) {
 	return attachments, nil
 }
 
+//scanWritingTemp scans a *sql.Row or *sql.Rows selected with writingTempColumns
+func scanWritingTemp(row interface{ Scan(...interface{}) error }) (*emailTemp, error) {
+	var pkID, markdown int
+	var rID, receiver, subject, body, cc, bcc string
+	err := row.Scan(&pkID, &rID, &receiver, &subject, &body, &markdown, &cc, &bcc)
+	if err != nil {
+		return nil, err
+	}
+	mrkdwn := false
+	if markdown == 1 {
+		mrkdwn = true
+	}
+	return &emailTemp{pkID, rID, receiver, subject, body, mrkdwn, cc, bcc}, nil
+}
+
+//getWritingTemp returns the email the user is currently writing
 func getWritingTemp(roomID string) (*emailTemp, error) {
-	stmt, err := db.Prepare("SELECT pk_id, roomID, receiver, subject, body, markdown FROM emailWritingTemp WHERE roomID=?")
+	stmt, err := db.Prepare("SELECT " + writingTempColumns + " FROM emailWritingTemp WHERE roomID=? AND active=1")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	var pkID, markdown int
-	var rID, receiver, subject, body string
-	err = stmt.QueryRow(roomID).Scan(&pkID, &rID, &receiver, &subject, &body, &markdown)
+	return scanWritingTemp(stmt.QueryRow(roomID))
+}
+
+//getDrafts returns all drafts of a room including the one currently written
+func getDrafts(roomID string) ([]emailTemp, error) {
+	rows, err := db.Query("SELECT "+writingTempColumns+" FROM emailWritingTemp WHERE roomID=? ORDER BY pk_id", roomID)
 	if err != nil {
 		return nil, err
 	}
-	mrkdwn := false
-	if markdown == 1 {
-		mrkdwn = true
+	defer rows.Close()
+	var drafts []emailTemp
+	for rows.Next() {
+		draft, err := scanWritingTemp(rows)
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, *draft)
 	}
-	return &emailTemp{pkID, rID, receiver, subject, body, mrkdwn}, nil
+	return drafts, rows.Err()
 }
 
 func saveWritingtemp(roomID, key, value string) error {
-	stmt, err := db.Prepare("UPDATE emailWritingTemp SET " + key + "=? WHERE roomID=?")
+	stmt, err := db.Prepare("UPDATE emailWritingTemp SET " + key + "=? WHERE roomID=? AND active=1")
 	if err != nil {
 		return err
 	}
@@ -287,7 +610,7 @@ func saveWritingtemp(roomID, key, value string) error {
 }
 
 func isUserWritingEmail(roomID string) (bool, error) {
-	stmt, err := db.Prepare("SELECT COUNT(*) FROM emailWritingTemp WHERE roomID=?")
+	stmt, err := db.Prepare("SELECT COUNT(*) FROM emailWritingTemp WHERE roomID=? AND active=1")
 	if err != nil {
 		return false, err
 	}
@@ -309,15 +632,27 @@ func deleteRoomAndEmailByRoomID(roomID string) {
 	checkErr(err)
 	stmt4.Exec(roomID)
 
-	deleteMails(roomID)
+	deleteMailboxStates(roomID)
+
+	stmt5, err := db.Prepare("DELETE FROM bridgedMails WHERE room=(SELECT pk_id FROM rooms WHERE roomID=?)")
+	checkErr(err)
+	stmt5.Exec(roomID)
+
+	stmt6, err := db.Prepare("DELETE FROM portals WHERE room=(SELECT pk_id FROM rooms WHERE roomID=?)")
+	checkErr(err)
+	stmt6.Exec(roomID)
 
 	stmt2, err := db.Prepare("DELETE FROM rooms WHERE roomID=?")
 	checkErr(err)
 	stmt2.Exec(roomID)
+
+	db.Exec("DELETE FROM outbox WHERE roomID=?", roomID)
+	deleteDrafts(roomID)
+	deleteUnusedOAuthTokens()
 }
 
-func deleteMails(roomID string) {
-	stmt3, err := db.Prepare("DELETE FROM mail WHERE room=(SELECT pk_id FROM rooms WHERE roomID=?)")
+func deleteMailboxStates(roomID string) {
+	stmt3, err := db.Prepare("DELETE FROM mailboxState WHERE room=(SELECT pk_id FROM rooms WHERE roomID=?)")
 	checkErr(err)
 	stmt3.Exec(roomID)
 }
@@ -383,7 +718,7 @@ func getRoomAccounts(roomID string) (imapAccount, smtpAccount int, err error) {
 }
 
 func insertNewRoom(roomID string, mailCheckInterval int) int64 {
-	stmt, err := db.Prepare("INSERT INTO rooms (roomID, mailCheckInterval, isHTMLenabled) VALUES(?,?,?)")
+	stmt, err := db.Prepare("INSERT INTO rooms (roomID, mailCheckInterval, isHTMLenabled, maxCatchUp, maxAttachmentSize) VALUES(?,?,?,?,?)")
 	checkErr(err)
 
 	isenabled := 0
@@ -391,7 +726,7 @@ func insertNewRoom(roomID string, mailCheckInterval int) int64 {
 		isenabled = 1
 	}
 
-	res, err := stmt.Exec(roomID, mailCheckInterval, isenabled)
+	res, err := stmt.Exec(roomID, mailCheckInterval, isenabled, viper.GetInt("defaultMaxCatchUp"), viper.GetInt("defaultMaxAttachmentSize"))
 	if err != nil {
 		WriteLog(critical, "#19 insertNewRoom could not execute err: "+err.Error())
 		return -1
@@ -432,6 +767,8 @@ func removeSMTPAccount(roomID string) {
 	stmt1, err := db.Prepare("UPDATE rooms SET smtpAccount=-1 WHERE roomID=?")
 	checkErr(err)
 	stmt1.Exec(roomID)
+
+	deleteUnusedOAuthTokens()
 }
 
 func hasRoom(roomID string) (bool, error) {
@@ -448,9 +785,9 @@ func hasRoom(roomID string) (bool, error) {
 	return (count > 0), nil
 }
 
-func insertSMTPAccountount(host string, port int, username, password string, ignoreSSL bool) (id int64, err error) {
+func insertSMTPAccountount(host string, port int, username, password string, ignoreSSL bool, security, authMethod string, oauthToken int) (id int64, err error) {
 	id = -1
-	stmt, err := db.Prepare("INSERT INTO smtpAccounts (host, port, username, password, ignoreSSL) VALUES(?,?,?,?,?)")
+	stmt, err := db.Prepare("INSERT INTO smtpAccounts (host, port, username, password, ignoreSSL, security, authMethod, oauthToken) VALUES(?,?,?,?,?,?,?,?)")
 	if !checkErr(err) {
 		WriteLog(critical, "#31 insertimapAccountount could not execute err: "+err.Error())
 		return
@@ -459,7 +796,12 @@ func insertSMTPAccountount(host string, port int, username, password string, ign
 	if ignoreSSL {
 		ign = 1
 	}
-	a, er := stmt.Exec(host, port, username, base64.StdEncoding.EncodeToString([]byte(password)), ign)
+	encPassword, err := encryptSecret(password)
+	if err != nil {
+		WriteLog(critical, "#108 insertSMTPAccountount could not encrypt password: "+err.Error())
+		return -1, err
+	}
+	a, er := stmt.Exec(host, port, username, encPassword, ign, security, authMethod, oauthToken)
 	if !checkErr(er) {
 		WriteLog(critical, "#32 insertimapAccountount could not execute err: "+err.Error())
 		return
@@ -471,8 +813,8 @@ func insertSMTPAccountount(host string, port int, username, password string, ign
 	return id, nil
 }
 
-func insertimapAccountount(host, username, password, mailbox string, ignoreSSl bool) (id int64, success bool) {
-	stmt, err := db.Prepare("INSERT INTO imapAccounts (host, username, password, ignoreSSL, mailbox) VALUES(?,?,?,?,?)")
+func insertimapAccountount(host, username, password, mailbox string, ignoreSSl bool, security, authMethod string, oauthToken int) (id int64, success bool) {
+	stmt, err := db.Prepare("INSERT INTO imapAccounts (host, username, password, ignoreSSL, mailbox, security, authMethod, oauthToken) VALUES(?,?,?,?,?,?,?,?)")
 	success = true
 	if !checkErr(err) {
 		WriteLog(critical, "#20 insertimapAccountount could not execute err: "+err.Error())
@@ -482,7 +824,12 @@ func insertimapAccountount(host, username, password, mailbox string, ignoreSSl b
 	if ignoreSSl {
 		ign = 1
 	}
-	a, er := stmt.Exec(host, username, base64.StdEncoding.EncodeToString([]byte(password)), ign, mailbox)
+	encPassword, err := encryptSecret(password)
+	if err != nil {
+		WriteLog(critical, "#109 insertimapAccountount could not encrypt password: "+err.Error())
+		return -1, false
+	}
+	a, er := stmt.Exec(host, username, encPassword, ign, mailbox, security, authMethod, oauthToken)
 	if !checkErr(er) {
 		WriteLog(critical, "#21 insertimapAccountount could not execute err: "+err.Error())
 		success = false
@@ -532,41 +879,41 @@ func isSMTPAccountAlreadyInUse(email string) (bool, error) {
 }
 
 func getimapAccounts() ([]imapAccountount, error) {
-	rows, err := db.Query("SELECT host, username, password, ignoreSSL, rooms.roomID, rooms.pk_id, rooms.mailCheckInterval, mailbox FROM imapAccounts INNER JOIN rooms ON (rooms.imapAccount = imapAccounts.pk_id)")
+	rows, err := db.Query("SELECT host, username, password, ignoreSSL, rooms.roomID, rooms.pk_id, rooms.mailCheckInterval, IFNULL(rooms.maxCatchUp, 0), mailbox, IFNULL(security, 'tls'), IFNULL(authMethod, 'password'), IFNULL(oauthToken, -1) FROM imapAccounts INNER JOIN rooms ON (rooms.imapAccount = imapAccounts.pk_id)")
 	if err != nil {
 		return nil, err
 	}
 
 	var list []imapAccountount
-	var host, username, password, roomID, mailbox string
-	var ignoreSSL, roomPKID, mailCheckInterval int
+	var host, username, password, roomID, mailbox, security, authMethod string
+	var ignoreSSL, roomPKID, mailCheckInterval, maxCatchUp, oauthToken int
 	for rows.Next() {
-		rows.Scan(&host, &username, &password, &ignoreSSL, &roomID, &roomPKID, &mailCheckInterval, &mailbox)
+		rows.Scan(&host, &username, &password, &ignoreSSL, &roomID, &roomPKID, &mailCheckInterval, &maxCatchUp, &mailbox, &security, &authMethod, &oauthToken)
 		ignssl := false
 		if ignoreSSL == 1 {
 			ignssl = true
 		}
-		pass, berr := base64.StdEncoding.DecodeString(password)
+		pass, berr := decryptSecret(password)
 		if berr != nil {
-			fmt.Println(berr.Error())
+			WriteLog(logError, "#110 getimapAccounts decrypt password of "+username+": "+berr.Error())
 			continue
 		}
-		list = append(list, imapAccountount{host, username, string(pass), roomID, mailbox, ignssl, roomPKID, mailCheckInterval, false})
+		list = append(list, imapAccountount{host, username, string(pass), roomID, mailbox, ignssl, roomPKID, mailCheckInterval, maxCatchUp, false, security, authMethod, oauthToken})
 	}
 	return list, nil
 }
 
 func getIMAPAccount(roomID string) (*imapAccountount, error) {
-	var host, username, password, rid, mailbox string
-	var ignoreSSL, roomPKID, mailCheckInterval int
+	var host, username, password, rid, mailbox, security, authMethod string
+	var ignoreSSL, roomPKID, mailCheckInterval, maxCatchUp, oauthToken int
 
-	res, err := db.Prepare("SELECT host, username, password, ignoreSSL, rooms.roomID, rooms.pk_id, rooms.mailCheckInterval, mailbox FROM imapAccounts INNER JOIN rooms ON (rooms.imapAccount = imapAccounts.pk_id) WHERE rooms.roomID=?")
+	res, err := db.Prepare("SELECT host, username, password, ignoreSSL, rooms.roomID, rooms.pk_id, rooms.mailCheckInterval, IFNULL(rooms.maxCatchUp, 0), mailbox, IFNULL(security, 'tls'), IFNULL(authMethod, 'password'), IFNULL(oauthToken, -1) FROM imapAccounts INNER JOIN rooms ON (rooms.imapAccount = imapAccounts.pk_id) WHERE rooms.roomID=?")
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = res.QueryRow(roomID).Scan(&host, &username, &password, &ignoreSSL, &rid, &roomPKID, &mailCheckInterval, &mailbox)
+	err = res.QueryRow(roomID).Scan(&host, &username, &password, &ignoreSSL, &rid, &roomPKID, &mailCheckInterval, &maxCatchUp, &mailbox, &security, &authMethod, &oauthToken)
 
 	if err != nil {
 		return nil, err
@@ -575,25 +922,25 @@ func getIMAPAccount(roomID string) (*imapAccountount, error) {
 	if ignoreSSL == 1 {
 		ignssl = true
 	}
-	pass, berr := base64.StdEncoding.DecodeString(password)
+	pass, berr := decryptSecret(password)
 
 	if berr != nil {
 		fmt.Println(berr.Error())
 		return nil, berr
 	}
 
-	return &imapAccountount{host, username, string(pass), roomID, mailbox, ignssl, roomPKID, mailCheckInterval, false}, nil
+	return &imapAccountount{host, username, string(pass), roomID, mailbox, ignssl, roomPKID, mailCheckInterval, maxCatchUp, false, security, authMethod, oauthToken}, nil
 }
 
 func getSMTPAccount(roomID string) (*smtpAccount, error) {
-	rows, err := db.Prepare("SELECT smtpAccounts.pk_id, host, port, username, password, rooms.pk_id, ignoreSSL FROM smtpAccounts INNER JOIN rooms ON (rooms.smtpAccount = smtpAccounts.pk_id) WHERE rooms.roomID=?")
+	rows, err := db.Prepare("SELECT smtpAccounts.pk_id, host, port, username, password, rooms.pk_id, ignoreSSL, IFNULL(security, 'opportunistic'), IFNULL(authMethod, 'password'), IFNULL(oauthToken, -1) FROM smtpAccounts INNER JOIN rooms ON (rooms.smtpAccount = smtpAccounts.pk_id) WHERE rooms.roomID=?")
 	if err != nil {
 		return nil, err
 	}
 
-	var host, username, password string
-	var ignoreSSL, roomPKID, pk, port int
-	err = rows.QueryRow(roomID).Scan(&pk, &host, &port, &username, &password, &roomPKID, &ignoreSSL)
+	var host, username, password, security, authMethod string
+	var ignoreSSL, roomPKID, pk, port, oauthToken int
+	err = rows.QueryRow(roomID).Scan(&pk, &host, &port, &username, &password, &roomPKID, &ignoreSSL, &security, &authMethod, &oauthToken)
 	if err != nil {
 		return nil, err
 	}
@@ -601,12 +948,12 @@ func getSMTPAccount(roomID string) (*smtpAccount, error) {
 	if ignoreSSL == 1 {
 		ignSSL = true
 	}
-	pass, berr := base64.StdEncoding.DecodeString(password)
+	pass, berr := decryptSecret(password)
 	if berr != nil {
 		fmt.Println(berr.Error())
 		return nil, berr
 	}
-	return &smtpAccount{host, username, string(pass), roomID, ignSSL, roomPKID, port, pk}, nil
+	return &smtpAccount{host, username, string(pass), roomID, ignSSL, roomPKID, port, pk, security, authMethod, oauthToken}, nil
 }
 
 func saveMailbox(roomID, newMailbox string) error {
@@ -661,6 +1008,208 @@ func setHTMLenabled(roomID string, enabled bool) error {
 	return nil
 }
 
+func setMaxCatchUp(roomID string, maxCatchUp int) error {
+	stmt, err := db.Prepare("UPDATE rooms SET maxCatchUp=? WHERE roomID=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(maxCatchUp, roomID)
+	return err
+}
+
+func isReadSyncEnabled(roomID string) (bool, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(syncReadState, 0) FROM rooms WHERE roomID=?")
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+	var isEnabled int
+	err = stmt.QueryRow(roomID).Scan(&isEnabled)
+	if err != nil {
+		return false, err
+	}
+	return isEnabled == 1, nil
+}
+
+func setReadSyncEnabled(roomID string, enabled bool) error {
+	stmt, err := db.Prepare("UPDATE rooms SET syncReadState=? WHERE roomID=?")
+	if err != nil {
+		return err
+	}
+	isenabled := 0
+	if enabled {
+		isenabled = 1
+	}
+	_, err = stmt.Exec(isenabled, roomID)
+	return err
+}
+
+//getRedactAction returns what happens to an email when its bridged event gets redacted
+func getRedactAction(roomID string) (string, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(redactAction, 'off') FROM rooms WHERE roomID=?")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	var action string
+	err = stmt.QueryRow(roomID).Scan(&action)
+	return action, err
+}
+
+func setRedactAction(roomID, action string) error {
+	stmt, err := db.Prepare("UPDATE rooms SET redactAction=? WHERE roomID=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(action, roomID)
+	return err
+}
+
+//getPortalMode returns whether emails of a room get posted into portal rooms
+func getPortalMode(roomID string) (string, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(portalMode, 'off') FROM rooms WHERE roomID=?")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	var mode string
+	err = stmt.QueryRow(roomID).Scan(&mode)
+	return mode, err
+}
+
+func setPortalMode(roomID, mode string) error {
+	stmt, err := db.Prepare("UPDATE rooms SET portalMode=? WHERE roomID=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(mode, roomID)
+	return err
+}
+
+const portalColumns = "portals.pk_id, portals.room, portals.portalRoomID, rooms.roomID, portals.mode, portals.correspondent"
+
+func scanPortal(row *sql.Row) (*portal, error) {
+	var p portal
+	err := row.Scan(&p.pk, &p.roomPKID, &p.roomID, &p.controlRoomID, &p.mode, &p.correspondent)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+//getPortalByRoomID returns the portal of a matrix room or nil if the room isn't a portal
+func getPortalByRoomID(roomID string) (*portal, error) {
+	return scanPortal(db.QueryRow("SELECT "+portalColumns+" FROM portals JOIN rooms ON rooms.pk_id=portals.room WHERE portals.portalRoomID=?", roomID))
+}
+
+//findCorrespondentPortal returns the portal of an email address or nil if there is none yet
+func findCorrespondentPortal(roomPK int, address string) (*portal, error) {
+	return scanPortal(db.QueryRow("SELECT "+portalColumns+" FROM portals JOIN rooms ON rooms.pk_id=portals.room WHERE portals.room=? AND portals.mode=? AND portals.correspondent=? ORDER BY portals.pk_id DESC LIMIT 1", roomPK, portalModeCorrespondent, address))
+}
+
+//findConversationPortal returns the portal of the conversation an email belongs to or nil if it starts a new one.
+//Like threads, conversations are matched by the referenced message IDs first and by subject and sender second
+func findConversationPortal(roomPK int, messageIDs []string, normalizedSubject, address string) (*portal, error) {
+	query := "SELECT " + portalColumns + " FROM portals JOIN rooms ON rooms.pk_id=portals.room JOIN bridgedMails ON bridgedMails.portal=portals.pk_id WHERE portals.room=? AND portals.mode=? AND "
+	for _, messageID := range messageIDs {
+		p, err := scanPortal(db.QueryRow(query+"bridgedMails.messageID=? ORDER BY bridgedMails.pk_id DESC LIMIT 1", roomPK, portalModeConversation, messageID))
+		if p != nil || err != nil {
+			return p, err
+		}
+	}
+	if len(normalizedSubject) == 0 {
+		return nil, nil
+	}
+	return scanPortal(db.QueryRow(query+"bridgedMails.normalizedSubject=? AND portals.correspondent=? ORDER BY bridgedMails.pk_id DESC LIMIT 1", roomPK, portalModeConversation, normalizedSubject, address))
+}
+
+func insertPortal(roomPK int, portalRoomID, mode, correspondent string) (int64, error) {
+	stmt, err := db.Prepare("INSERT INTO portals (room, portalRoomID, mode, correspondent) VALUES(?,?,?,?)")
+	if err != nil {
+		return -1, err
+	}
+	res, err := stmt.Exec(roomPK, portalRoomID, mode, correspondent)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+func deletePortal(portalRoomID string) error {
+	_, err := db.Exec("DELETE FROM portals WHERE portalRoomID=?", portalRoomID)
+	return err
+}
+
+//getPortalRoomIDs returns the portal rooms of a bridged room
+func getPortalRoomIDs(roomID string) ([]string, error) {
+	rows, err := db.Query("SELECT portalRoomID FROM portals WHERE room=(SELECT pk_id FROM rooms WHERE roomID=?)", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roomIDs []string
+	for rows.Next() {
+		var portalRoomID string
+		if err := rows.Scan(&portalRoomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, portalRoomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+//getLatestMailInPortal returns the newest email posted into a portal
+func getLatestMailInPortal(portalPK int) (*bridgedMail, error) {
+	stmt, err := db.Prepare("SELECT " + bridgedMailColumns + " FROM bridgedMails WHERE portal=? ORDER BY pk_id DESC LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	return scanBridgedMail(stmt.QueryRow(portalPK))
+}
+
+//fallbackMaxAttachmentSize is the maximum attachment size in MB if the config doesn't set a valid one
+const fallbackMaxAttachmentSize = 10
+
+//defaultMaxAttachmentSize returns the default maximum size of a bridged attachment in bytes
+func defaultMaxAttachmentSize() int64 {
+	maxSize := viper.GetInt64("defaultMaxAttachmentSize")
+	if maxSize <= 0 {
+		maxSize = fallbackMaxAttachmentSize
+	}
+	return maxSize * 1024 * 1024
+}
+
+//getMaxAttachmentSize returns the maximum size of a bridged attachment in bytes.
+//Rooms without a size (0 or NULL) use the default
+func getMaxAttachmentSize(roomID string) (int64, error) {
+	stmt, err := db.Prepare("SELECT IFNULL(maxAttachmentSize, 0) FROM rooms WHERE roomID=?")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	var maxSize int64
+	err = stmt.QueryRow(roomID).Scan(&maxSize)
+	if err != nil {
+		return 0, err
+	}
+	if maxSize <= 0 {
+		return defaultMaxAttachmentSize(), nil
+	}
+	return maxSize * 1024 * 1024, nil
+}
+
+func setMaxAttachmentSize(roomID string, maxSize int) error {
+	stmt, err := db.Prepare("UPDATE rooms SET maxAttachmentSize=? WHERE roomID=?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(maxSize, roomID)
+	return err
+}
+
 func getBlocklist(imapAccount int) []string {
 	rows, err := db.Query("SELECT address FROM blocklist WHERE imapAccount=?", imapAccount)
 	if err != nil {
@@ -742,3 +1291,218 @@ func checkForBlocklist(roomID string, senderEmail string) bool {
 	}
 	return false
 }
+
+func insertOAuthToken(provider, username, refreshToken, accessToken string, expiry time.Time) (int64, error) {
+	encRefreshToken, err := encryptSecret(refreshToken)
+	if err != nil {
+		return -1, err
+	}
+	encAccessToken, err := encryptSecret(accessToken)
+	if err != nil {
+		return -1, err
+	}
+	res, err := db.Exec("INSERT INTO oauthTokens (provider, username, refreshToken, accessToken, expiry) VALUES(?,?,?,?,?)", provider, username, encRefreshToken, encAccessToken, expiry.Unix())
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+//findOAuthToken returns the id of the token of the given account or -1 if it wasn't authorized yet
+func findOAuthToken(provider, username string) (int, error) {
+	var tokenID int
+	err := db.QueryRow("SELECT pk_id FROM oauthTokens WHERE provider=? AND username=?", provider, username).Scan(&tokenID)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return tokenID, nil
+}
+
+func getOAuthToken(tokenID int) (provider, refreshToken, accessToken string, expiry time.Time, err error) {
+	var expiryUnix int64
+	err = db.QueryRow("SELECT provider, refreshToken, accessToken, expiry FROM oauthTokens WHERE pk_id=?", tokenID).Scan(&provider, &refreshToken, &accessToken, &expiryUnix)
+	if err != nil {
+		return
+	}
+	expiry = time.Unix(expiryUnix, 0)
+	if refreshToken, err = decryptSecret(refreshToken); err != nil {
+		return
+	}
+	accessToken, err = decryptSecret(accessToken)
+	return
+}
+
+func updateOAuthToken(tokenID int, refreshToken, accessToken string, expiry time.Time) error {
+	encRefreshToken, err := encryptSecret(refreshToken)
+	if err != nil {
+		return err
+	}
+	encAccessToken, err := encryptSecret(accessToken)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE oauthTokens SET refreshToken=?, accessToken=?, expiry=? WHERE pk_id=?", encRefreshToken, encAccessToken, expiry.Unix(), tokenID)
+	return err
+}
+
+//deleteUnusedOAuthTokens removes tokens which don't belong to an account anymore
+func deleteUnusedOAuthTokens() {
+	_, err := db.Exec("DELETE FROM oauthTokens WHERE pk_id NOT IN (SELECT oauthToken FROM imapAccounts) AND pk_id NOT IN (SELECT oauthToken FROM smtpAccounts)")
+	if err != nil {
+		WriteLog(logError, "#105 deleteUnusedOAuthTokens: "+err.Error())
+	}
+}
+
+//hasEncryptedCredentials returns true if any stored password or token is encrypted
+func hasEncryptedCredentials() (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT (SELECT COUNT(pk_id) FROM imapAccounts WHERE password LIKE ?) + (SELECT COUNT(pk_id) FROM smtpAccounts WHERE password LIKE ?) + (SELECT COUNT(pk_id) FROM oauthTokens WHERE refreshToken LIKE ?)",
+		encryptedPrefix+"%", encryptedPrefix+"%", encryptedPrefix+"%").Scan(&count)
+	return count > 0, err
+}
+
+//encryptStoredCredentials encrypts all passwords and tokens which were stored before the encryption was added
+func encryptStoredCredentials() error {
+	for _, accountTable := range []string{"imapAccounts", "smtpAccounts"} {
+		rows, err := db.Query("SELECT pk_id, password FROM "+accountTable+" WHERE password NOT LIKE ?", encryptedPrefix+"%")
+		if err != nil {
+			return err
+		}
+		passwords := make(map[int]string)
+		for rows.Next() {
+			var pk int
+			var password string
+			if err := rows.Scan(&pk, &password); err != nil {
+				rows.Close()
+				return err
+			}
+			passwords[pk] = password
+		}
+		rows.Close()
+
+		for pk, password := range passwords {
+			plain, err := base64.StdEncoding.DecodeString(password)
+			if err != nil {
+				return err
+			}
+			encPassword, err := encryptSecret(string(plain))
+			if err != nil {
+				return err
+			}
+			if _, err = db.Exec("UPDATE "+accountTable+" SET password=? WHERE pk_id=?", encPassword, pk); err != nil {
+				return err
+			}
+		}
+		if len(passwords) > 0 {
+			WriteLog(info, "encrypted "+strconv.Itoa(len(passwords))+" passwords in "+accountTable)
+		}
+	}
+
+	rows, err := db.Query("SELECT pk_id, refreshToken, accessToken, expiry FROM oauthTokens WHERE refreshToken NOT LIKE ?", encryptedPrefix+"%")
+	if err != nil {
+		return err
+	}
+	type plainToken struct {
+		refreshToken, accessToken string
+		expiry                    int64
+	}
+	tokens := make(map[int]plainToken)
+	for rows.Next() {
+		var pk int
+		var token plainToken
+		if err := rows.Scan(&pk, &token.refreshToken, &token.accessToken, &token.expiry); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[pk] = token
+	}
+	rows.Close()
+	for pk, token := range tokens {
+		if err = updateOAuthToken(pk, token.refreshToken, token.accessToken, time.Unix(token.expiry, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const outboxColumns = "pk_id, roomID, sender, recipients, subject, message, status, attempts, nextAttempt, lastError"
+
+func scanOutboxMails(rows *sql.Rows) ([]outboxMail, error) {
+	defer rows.Close()
+	var mails []outboxMail
+	for rows.Next() {
+		var mail outboxMail
+		err := rows.Scan(&mail.pk, &mail.roomID, &mail.sender, &mail.recipients, &mail.subject, &mail.message, &mail.status, &mail.attempts, &mail.nextAttempt, &mail.lastError)
+		if err != nil {
+			return nil, err
+		}
+		mails = append(mails, mail)
+	}
+	return mails, rows.Err()
+}
+
+func insertOutboxMail(roomID, sender, recipients, subject string, message []byte, status string, nextAttempt int64) (int64, error) {
+	res, err := db.Exec("INSERT INTO outbox (roomID, sender, recipients, subject, message, status, nextAttempt) VALUES(?,?,?,?,?,?,?)", roomID, sender, recipients, subject, message, status, nextAttempt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+//getDueOutboxMails returns the queued and scheduled emails which have to be sent until now
+func getDueOutboxMails(now int64) ([]outboxMail, error) {
+	rows, err := db.Query("SELECT "+outboxColumns+" FROM outbox WHERE status IN (?,?) AND nextAttempt<=? ORDER BY nextAttempt, pk_id", outboxQueued, outboxScheduled, now)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxMails(rows)
+}
+
+func getOutboxMails(roomID string) ([]outboxMail, error) {
+	rows, err := db.Query("SELECT "+outboxColumns+" FROM outbox WHERE roomID=? ORDER BY pk_id", roomID)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxMails(rows)
+}
+
+//updateOutboxMail saves the result of an attempt to send an email
+func updateOutboxMail(pk int, status string, attempts int, nextAttempt int64, lastError string) error {
+	_, err := db.Exec("UPDATE outbox SET status=?, attempts=?, nextAttempt=?, lastError=? WHERE pk_id=?", status, attempts, nextAttempt, lastError, pk)
+	return err
+}
+
+//pauseOutbox pauses all queued emails of a room
+func pauseOutbox(roomID, lastError string) error {
+	_, err := db.Exec("UPDATE outbox SET status=?, lastError=? WHERE roomID=? AND status=?", outboxPaused, lastError, roomID, outboxQueued)
+	return err
+}
+
+//retryOutbox queues paused and failed emails of a room again. pk -1 retries all of them
+func retryOutbox(roomID string, pk int) (int64, error) {
+	res, err := db.Exec("UPDATE outbox SET status=?, attempts=0, nextAttempt=0 WHERE roomID=? AND status!=? AND (pk_id=? OR ?=-1)", outboxQueued, roomID, outboxScheduled, pk, pk)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+//unscheduleMail deletes a scheduled email before it gets sent
+func unscheduleMail(roomID string, pk int) (int64, error) {
+	res, err := db.Exec("DELETE FROM outbox WHERE roomID=? AND pk_id=? AND status=?", roomID, pk, outboxScheduled)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func deleteOutboxMail(roomID string, pk int) (int64, error) {
+	res, err := db.Exec("DELETE FROM outbox WHERE roomID=? AND pk_id=?", roomID, pk)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
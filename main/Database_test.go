@@ -0,0 +1,325 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetMaxAttachmentSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		size          interface{}
+		configDefault int
+		want          int64
+	}{
+		{"room size", 5, 20, 5 << 20},
+		{"zero uses the config", 0, 20, 20 << 20},
+		{"null uses the config", nil, 20, 20 << 20},
+		{"invalid config", 0, 0, fallbackMaxAttachmentSize << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDB(t)
+			viper.Set("defaultMaxAttachmentSize", test.configDefault)
+			defer viper.Set("defaultMaxAttachmentSize", nil)
+			if _, err := db.Exec("INSERT INTO rooms (roomID, maxAttachmentSize) VALUES(?,?)", testRoom.String(), test.size); err != nil {
+				t.Fatal(err)
+			}
+			got, err := getMaxAttachmentSize(testRoom.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("getMaxAttachmentSize = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSMTPSecurityMigration(t *testing.T) {
+	setupTestDB(t)
+	//the smtp accounts as they were before the security mode existed
+	for _, query := range []string{
+		"DROP TABLE smtpAccounts",
+		"CREATE TABLE smtpAccounts (pk_id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, port int, username TEXT, password TEXT, ignoreSSL INTEGER)",
+		"INSERT INTO smtpAccounts (host, port) VALUES('mail.example.org', 465), ('mail.example.org', 587), ('localhost', 25)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startDBupgrader(14)
+
+	rows, err := db.Query("SELECT port, security FROM smtpAccounts ORDER BY pk_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[int]string)
+	for rows.Next() {
+		var port int
+		var security string
+		if err = rows.Scan(&port, &security); err != nil {
+			t.Fatal(err)
+		}
+		got[port] = security
+	}
+	//existing accounts keep using STARTTLS only if it's offered
+	want := map[int]string{465: securityTLS, 587: securityOpportunistic, 25: securityOpportunistic}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("migrated security modes = %v, want %v", got, want)
+	}
+
+	//new accounts require STARTTLS unless configured otherwise
+	if _, err = db.Exec("INSERT INTO smtpAccounts (host, port) VALUES('mail.example.org', 587)"); err != nil {
+		t.Fatal(err)
+	}
+	var security string
+	if err = db.QueryRow("SELECT security FROM smtpAccounts ORDER BY pk_id DESC LIMIT 1").Scan(&security); err != nil || security != securityStartTLS {
+		t.Errorf("security of a new account = %q, %v, want %q", security, err, securityStartTLS)
+	}
+}
+
+//setupTestPortals creates testRoom with the conversation portals !a and !b and the correspondent portal !c.
+//Each of them holds one bridged email
+func setupTestPortals(t *testing.T) {
+	t.Helper()
+	setupTestDB(t)
+	if _, err := db.Exec("INSERT INTO rooms (roomID) VALUES(?)", testRoom.String()); err != nil {
+		t.Fatal(err)
+	}
+	portals := []struct {
+		roomID, mode, correspondent, eventID, messageID, subject string
+	}{
+		{"!a:example.org", portalModeConversation, "a@example.org", "$a1", "<a1@example.org>", "hello"},
+		{"!b:example.org", portalModeConversation, "b@example.org", "$b1", "<b1@example.org>", "hello"},
+		{"!c:example.org", portalModeCorrespondent, "c@example.org", "$c1", "<c1@example.org>", "news"},
+	}
+	for i, p := range portals {
+		pk, err := insertPortal(1, p.roomID, p.mode, p.correspondent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = saveBridgedMail(bridgedMail{roomPKID: 1, eventID: p.eventID, messageID: p.messageID, sender: p.correspondent,
+			mailbox: "INBOX", uidValidity: 1, uid: uint32(i + 1), normalizedSubject: p.subject, portal: int(pk)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindConversationPortal(t *testing.T) {
+	setupTestPortals(t)
+	tests := []struct {
+		name       string
+		roomPK     int
+		messageIDs []string
+		subject    string
+		address    string
+		want       string
+	}{
+		{"referenced message", 1, []string{"<a1@example.org>"}, "", "x@example.org", "!a:example.org"},
+		{"later reference", 1, []string{"<unknown@example.org>", "<b1@example.org>"}, "", "x@example.org", "!b:example.org"},
+		{"subject and sender", 1, nil, "hello", "a@example.org", "!a:example.org"},
+		{"same subject of another sender", 1, nil, "hello", "b@example.org", "!b:example.org"},
+		{"subject of an unknown sender", 1, nil, "hello", "x@example.org", ""},
+		{"correspondent portal", 1, []string{"<c1@example.org>"}, "news", "c@example.org", ""},
+		{"no subject", 1, nil, "", "a@example.org", ""},
+		{"other room", 2, []string{"<a1@example.org>"}, "hello", "a@example.org", ""},
+	}
+	for _, test := range tests {
+		p, err := findConversationPortal(test.roomPK, test.messageIDs, test.subject, test.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if p != nil {
+			got = p.roomID
+			if p.controlRoomID != testRoom.String() {
+				t.Errorf("%s: controlRoomID = %q", test.name, p.controlRoomID)
+			}
+		}
+		if got != test.want {
+			t.Errorf("%s: findConversationPortal = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetUnseenMailsOfPortal(t *testing.T) {
+	setupTestPortals(t)
+	//a receipt in one portal doesn't mark the emails of earlier portals
+	mails, err := getUnseenMails(testRoom.String(), "$b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 || mails[0].uid != 2 {
+		t.Errorf("getUnseenMails($b1) = %v, want the email with the UID 2", mails)
+	}
+	if err = setMailsSeen(testRoom.String(), "$b1"); err != nil {
+		t.Fatal(err)
+	}
+	if mails, _ = getUnseenMails(testRoom.String(), "$b1"); len(mails) != 0 {
+		t.Errorf("getUnseenMails($b1) after setMailsSeen = %v", mails)
+	}
+	if mails, _ = getUnseenMails(testRoom.String(), "$a1"); len(mails) != 1 || mails[0].uid != 1 {
+		t.Errorf("getUnseenMails($a1) = %v, want the email with the UID 1", mails)
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	setupTestDB(t)
+	room := testRoom.String()
+	activeReceiver := func() string {
+		writeTemp, err := getWritingTemp(room)
+		if err != nil {
+			return err.Error()
+		}
+		return writeTemp.receiver
+	}
+
+	if err := newWritingTemp(room, "a@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pauseWritingTemp(room); err != nil {
+		t.Fatal(err)
+	}
+	if writing, _ := isUserWritingEmail(room); writing {
+		t.Errorf("a paused draft counts as writing")
+	}
+	if err := newWritingTemp(room, "b@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := newWritingTemp("!other:example.org", "c@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	drafts, err := getDrafts(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drafts) != 2 || drafts[0].receiver != "a@example.org" || drafts[1].receiver != "b@example.org" {
+		t.Fatalf("getDrafts = %+v", drafts)
+	}
+	if got := activeReceiver(); got != "b@example.org" {
+		t.Errorf("active draft = %s, want b@example.org", got)
+	}
+
+	if ok, err := resumeDraft(room, drafts[0].pkID); !ok || err != nil {
+		t.Errorf("resumeDraft(a) = %v, %v", ok, err)
+	}
+	if got := activeReceiver(); got != "a@example.org" {
+		t.Errorf("active draft after resuming = %s, want a@example.org", got)
+	}
+	//drafts of other rooms can't be resumed or deleted
+	if ok, _ := resumeDraft(room, 3); ok {
+		t.Errorf("resumed the draft of another room")
+	}
+	if ok, _ := deleteDraft(room, 3); ok {
+		t.Errorf("deleted the draft of another room")
+	}
+
+	if err = addEmailAttachment(drafts[1].pkID, "attachment.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := deleteDraft(room, drafts[1].pkID); !ok || err != nil {
+		t.Errorf("deleteDraft(b) = %v, %v", ok, err)
+	}
+	if attachments, _ := getAttachments(drafts[1].pkID); len(attachments) != 0 {
+		t.Errorf("attachments of the deleted draft = %v", attachments)
+	}
+	if ok, _ := deleteDraft(room, drafts[1].pkID); ok {
+		t.Errorf("deleted draft b twice")
+	}
+
+	if err = deleteDrafts(room); err != nil {
+		t.Fatal(err)
+	}
+	if drafts, _ = getDrafts(room); len(drafts) != 0 {
+		t.Errorf("drafts after deleteDrafts = %+v", drafts)
+	}
+	if drafts, _ = getDrafts("!other:example.org"); len(drafts) != 1 {
+		t.Errorf("deleteDrafts removed the drafts of another room")
+	}
+}
+
+func TestDraftLinesMigration(t *testing.T) {
+	setupTestDB(t)
+	//drafts written before the lines were stored separately
+	_, err := db.Exec("INSERT INTO emailWritingTemp (roomID, receiver, body) VALUES(?, 'a@example.org', ?), (?, 'b@example.org', ' ')",
+		testRoom.String(), "line one\r\nline two\r\n", testRoom.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	startDBupgrader(19)
+
+	var count int
+	var line string
+	if err = db.QueryRow("SELECT COUNT(*), MAX(line) FROM draftLines WHERE writeTempID=1 AND eventID=''").Scan(&count, &line); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || line != "line one\r\nline two" {
+		t.Errorf("migrated lines = %d, %q", count, line)
+	}
+	if db.QueryRow("SELECT COUNT(*) FROM draftLines WHERE writeTempID=2").Scan(&count); count != 0 {
+		t.Errorf("the empty draft got %d lines", count)
+	}
+
+	//the old body is kept when new lines are added
+	if err = addDraftLine(1, "$three", "line three"); err != nil {
+		t.Fatal(err)
+	}
+	var body string
+	db.QueryRow("SELECT body FROM emailWritingTemp WHERE pk_id=1").Scan(&body)
+	if body != "line one\r\nline two\r\nline three\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestRebuildDraftBody(t *testing.T) {
+	setupTestDB(t)
+	if err := newWritingTemp(testRoom.String(), "a@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	body := func() string {
+		writeTemp, err := getWritingTemp(testRoom.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writeTemp.body
+	}
+
+	addDraftLine(1, "$one", "one")
+	addDraftLine(1, "$two", "two")
+	addDraftLine(1, "$three", "three")
+	if got := body(); got != "one\r\ntwo\r\nthree\r\n" {
+		t.Errorf("body after adding = %q", got)
+	}
+	if err := updateDraftLine(1, "$two", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := body(); got != "one\r\n2\r\nthree\r\n" {
+		t.Errorf("body after updating = %q", got)
+	}
+	if err := deleteDraftLine(1, "$one"); err != nil {
+		t.Fatal(err)
+	}
+	if got := body(); got != "2\r\nthree\r\n" {
+		t.Errorf("body after deleting = %q", got)
+	}
+
+	if writeTempID, _ := getDraftOfLine(testRoom.String(), "$three"); writeTempID != 1 {
+		t.Errorf("getDraftOfLine($three) = %d, want 1", writeTempID)
+	}
+	if writeTempID, _ := getDraftOfLine("!other:example.org", "$three"); writeTempID != -1 {
+		t.Errorf("getDraftOfLine found the line in another room")
+	}
+	deleteDraftData(1)
+	if got := body(); got != "2\r\nthree\r\n" {
+		t.Errorf("deleting the lines changed the body to %q", got)
+	}
+	if writeTempID, _ := getDraftOfLine(testRoom.String(), "$three"); writeTempID != -1 {
+		t.Errorf("line still exists after deleteDraftData")
+	}
+}
@@ -0,0 +1,229 @@
+//go:build e2ee
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var olmMachine *crypto.OlmMachine
+
+//running SAS verifications waiting for !verify, by user
+var pendingVerifications = make(map[id.UserID]chan bool)
+var verificationMutex sync.Mutex
+
+//cryptoLogger writes the log of the olm machine into the bridge log
+type cryptoLogger struct{}
+
+func (cryptoLogger) Error(message string, args ...interface{}) {
+	WriteLog(logError, "crypto: "+fmt.Sprintf(message, args...))
+}
+
+func (cryptoLogger) Warn(message string, args ...interface{}) {
+	WriteLog(warn, "crypto: "+fmt.Sprintf(message, args...))
+}
+
+func (cryptoLogger) Debug(message string, args ...interface{}) {}
+
+func (cryptoLogger) Trace(message string, args ...interface{}) {}
+
+//FindSharedRooms returns the encrypted rooms the bot shares with a user
+func (fs *FileStore) FindSharedRooms(userID id.UserID) []id.RoomID {
+	var shared []id.RoomID
+	fs.encryptionLock.Lock()
+	rooms := make([]id.RoomID, 0, len(fs.Encryption))
+	for roomID, content := range fs.Encryption {
+		if content != nil {
+			rooms = append(rooms, roomID)
+		}
+	}
+	fs.encryptionLock.Unlock()
+
+	for _, roomID := range rooms {
+		members, err := matrixClient.JoinedMembers(roomID)
+		if err != nil {
+			continue
+		}
+		if _, ok := members.Joined[userID]; ok {
+			shared = append(shared, roomID)
+		}
+	}
+	return shared
+}
+
+//initCrypto loads the olm account and registers the sync handlers required for encryption
+func initCrypto() error {
+	cryptoStore, err := crypto.NewGobStore(dirPrefix + "crypto.gob")
+	if err != nil {
+		return err
+	}
+	mach := crypto.NewOlmMachine(matrixClient, cryptoLogger{}, cryptoStore, store)
+	if err = mach.Load(); err != nil {
+		return err
+	}
+	mach.AllowKeyShare = allowKeyShare
+	mach.AcceptVerificationFrom = acceptVerificationFrom
+	olmMachine = mach
+
+	syncer := matrixClient.Syncer.(*mautrix.DefaultSyncer)
+	syncer.OnSync(mach.ProcessSyncResponse)
+	syncer.OnEventType(event.StateMember, func(source mautrix.EventSource, evt *event.Event) {
+		mach.HandleMemberEvent(evt)
+	})
+	WriteLog(info, "end-to-end encryption enabled, device "+matrixClient.DeviceID.String())
+	return nil
+}
+
+func encryptEvent(roomID id.RoomID, eventType event.Type, content interface{}) (*event.EncryptedEventContent, error) {
+	encrypted, err := olmMachine.EncryptMegolmEvent(roomID, eventType, content)
+	if !crypto.IsShareError(err) {
+		return encrypted, err
+	}
+
+	members, err := matrixClient.JoinedMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]id.UserID, 0, len(members.Joined))
+	for userID := range members.Joined {
+		users = append(users, userID)
+	}
+	if err = olmMachine.ShareGroupSession(roomID, users); err != nil {
+		return nil, err
+	}
+	return olmMachine.EncryptMegolmEvent(roomID, eventType, content)
+}
+
+func decryptEvent(evt *event.Event) (*event.Event, error) {
+	return olmMachine.DecryptMegolmEvent(evt)
+}
+
+//notifyUndecryptable tells the user that a message couldn't be decrypted
+func notifyUndecryptable(evt *event.Event) {
+	sendNotice(evt.RoomID, "I couldn't decrypt your message. If you sent it from a new session, verify my device or send the message again")
+}
+
+//allowKeyShare answers key requests of devices from users sharing an encrypted room with the bot
+func allowKeyShare(device *crypto.DeviceIdentity, info event.RequestedKeyInfo) *crypto.KeyShareRejection {
+	if device.Trust == crypto.TrustStateBlacklisted {
+		return &crypto.KeyShareRejectBlacklisted
+	}
+	if device.UserID == matrixClient.UserID && device.DeviceID == matrixClient.DeviceID {
+		return &crypto.KeyShareRejectNoResponse
+	}
+	for _, roomID := range store.FindSharedRooms(device.UserID) {
+		if roomID == info.RoomID {
+			return nil
+		}
+	}
+	return &crypto.KeyShareRejectOtherUser
+}
+
+//acceptVerificationFrom accepts SAS verifications of users from allowed servers
+func acceptVerificationFrom(transactionID string, device *crypto.DeviceIdentity, roomID id.RoomID) (crypto.VerificationRequestResponse, crypto.VerificationHooks) {
+	host, err := getHostFromMatrixID(device.UserID.String())
+	if err != -1 || !contains(viper.GetStringSlice("allowed_servers"), host) {
+		return crypto.RejectRequest, nil
+	}
+	return crypto.AcceptRequest, &verificationHooks{device.UserID, roomID}
+}
+
+//verificationHooks asks the user in matrix whether the SAS matches
+type verificationHooks struct {
+	userID id.UserID
+	roomID id.RoomID
+}
+
+func (h *verificationHooks) rooms() []id.RoomID {
+	if len(h.roomID) > 0 {
+		return []id.RoomID{h.roomID}
+	}
+	return store.FindSharedRooms(h.userID)
+}
+
+func (h *verificationHooks) notify(text string) {
+	for _, roomID := range h.rooms() {
+		sendNotice(roomID, text)
+	}
+}
+
+func (h *verificationHooks) VerifySASMatch(otherDevice *crypto.DeviceIdentity, sas crypto.SASData) bool {
+	var code string
+	switch data := sas.(type) {
+	case crypto.EmojiSASData:
+		parts := make([]string, len(data))
+		for i, emoji := range data {
+			parts[i] = string(emoji.Emoji) + " (" + emoji.Description + ")"
+		}
+		code = strings.Join(parts, " ")
+	case crypto.DecimalSASData:
+		code = fmt.Sprintf("%d %d %d", data[0], data[1], data[2])
+	default:
+		return false
+	}
+
+	answer := make(chan bool, 1)
+	verificationMutex.Lock()
+	pendingVerifications[h.userID] = answer
+	verificationMutex.Unlock()
+	defer func() {
+		verificationMutex.Lock()
+		if pendingVerifications[h.userID] == answer {
+			delete(pendingVerifications, h.userID)
+		}
+		verificationMutex.Unlock()
+	}()
+
+	h.notify("Verification of " + otherDevice.DeviceID.String() + " by " + h.userID.String() + ":\r\n" + code + "\r\nDo they match? Answer with !verify yes or !verify no")
+	return <-answer
+}
+
+func (h *verificationHooks) VerificationMethods() []crypto.VerificationMethod {
+	return []crypto.VerificationMethod{crypto.VerificationMethodEmoji{}, crypto.VerificationMethodDecimal{}}
+}
+
+func (h *verificationHooks) OnCancel(cancelledByUs bool, reason string, reasonCode event.VerificationCancelCode) {
+	verificationMutex.Lock()
+	if answer, ok := pendingVerifications[h.userID]; ok {
+		answer <- false
+		delete(pendingVerifications, h.userID)
+	}
+	verificationMutex.Unlock()
+	h.notify("Verification cancelled: " + reason)
+}
+
+func (h *verificationHooks) OnSuccess() {
+	h.notify("Verification successful")
+}
+
+//verify answers a running SAS verification
+func verify(evt *event.Event, message string) {
+	var match bool
+	switch strings.ToLower(strings.TrimSpace(message)) {
+	case "yes", "y":
+		match = true
+	case "no", "n":
+		match = false
+	default:
+		sendText(evt.RoomID, "Usage: !verify yes/no")
+		return
+	}
+
+	verificationMutex.Lock()
+	answer, ok := pendingVerifications[evt.Sender]
+	delete(pendingVerifications, evt.Sender)
+	verificationMutex.Unlock()
+	if !ok {
+		sendText(evt.RoomID, "There is no verification waiting for your answer")
+		return
+	}
+	answer <- match
+}
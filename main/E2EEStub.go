@@ -0,0 +1,45 @@
+//go:build !e2ee
+
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var errNoCrypto = errors.New("built without E2EE support")
+
+//rooms which were already told that encryption isn't supported
+var undecryptableNotified = make(map[id.RoomID]bool)
+var undecryptableMutex sync.Mutex
+
+func initCrypto() error {
+	WriteLog(info, "built without E2EE support, encrypted rooms can't be used. Build with -tags e2ee to enable it")
+	return nil
+}
+
+func encryptEvent(roomID id.RoomID, eventType event.Type, content interface{}) (*event.EncryptedEventContent, error) {
+	return nil, errNoCrypto
+}
+
+func decryptEvent(evt *event.Event) (*event.Event, error) {
+	return nil, errNoCrypto
+}
+
+//notifyUndecryptable tells the room once that this build can't decrypt messages. The notice is sent unencrypted, there is no other way
+func notifyUndecryptable(evt *event.Event) {
+	undecryptableMutex.Lock()
+	notified := undecryptableNotified[evt.RoomID]
+	undecryptableNotified[evt.RoomID] = true
+	undecryptableMutex.Unlock()
+	if !notified {
+		matrixClient.SendNotice(evt.RoomID, "This room is encrypted but the bridge was built without E2EE support. Ask your admin to build it with -tags e2ee or use an unencrypted room")
+	}
+}
+
+func verify(evt *event.Event, message string) {
+	sendNotice(evt.RoomID, "The bridge was built without E2EE support")
+}
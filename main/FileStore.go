@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"sync"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -17,6 +19,11 @@ type FileStore struct {
 	FilterID  string                      `json:"filter_id"`
 	NextBatch string                      `json:"next_batch"`
 	Rooms     map[id.RoomID]*mautrix.Room `json:"rooms"`
+	DeviceID  id.DeviceID                 `json:"device_id"`
+
+	//encryption state of the rooms, nil if a room isn't encrypted
+	Encryption     map[id.RoomID]*event.EncryptionEventContent `json:"encryption"`
+	encryptionLock sync.Mutex
 }
 
 //NewFileStore creates a new filestore
@@ -99,3 +106,55 @@ func (fs *FileStore) GetMembershipState(roomID id.RoomID) (event.Membership, int
 	room := fs.LoadRoom(roomID)
 	return room.GetMembershipState(fs.userID), room.State[event.StateMember][string(fs.userID)].Timestamp
 }
+
+//IsEncrypted returns true if the room has encryption enabled
+func (fs *FileStore) IsEncrypted(roomID id.RoomID) bool {
+	return fs.GetEncryptionEvent(roomID) != nil
+}
+
+//GetEncryptionEvent returns the encryption settings of a room or nil if it isn't encrypted
+func (fs *FileStore) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
+	fs.encryptionLock.Lock()
+	content, ok := fs.Encryption[roomID]
+	fs.encryptionLock.Unlock()
+	if ok {
+		return content
+	}
+
+	//rooms joined before the encryption state was tracked. The lock isn't held during the request
+	content = &event.EncryptionEventContent{}
+	err := matrixClient.StateEvent(roomID, event.StateEncryption, "", content)
+	if errors.Is(err, mautrix.MNotFound) {
+		content = nil
+	} else if err != nil {
+		//treat the room as encrypted, so nothing gets sent unencrypted by mistake.
+		//Not cached, so the next message asks again
+		WriteLog(logError, "#119 getting encryption state of "+roomID.String()+": "+err.Error())
+		return &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}
+	}
+
+	fs.encryptionLock.Lock()
+	defer fs.encryptionLock.Unlock()
+	//the encryption event might have arrived by sync during the request
+	if synced, ok := fs.Encryption[roomID]; ok {
+		return synced
+	}
+	if fs.Encryption == nil {
+		fs.Encryption = make(map[id.RoomID]*event.EncryptionEventContent)
+	}
+	fs.Encryption[roomID] = content
+	fs.Save()
+	return content
+}
+
+//SetEncryptionEvent saves the encryption settings of a room
+func (fs *FileStore) SetEncryptionEvent(evt *event.Event) {
+	content := evt.Content.AsEncryption()
+	fs.encryptionLock.Lock()
+	defer fs.encryptionLock.Unlock()
+	if fs.Encryption == nil {
+		fs.Encryption = make(map[id.RoomID]*event.EncryptionEventContent)
+	}
+	fs.Encryption[evt.RoomID] = content
+	fs.Save()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+//tags (and their attributes) which matrix clients are allowed to render
+//https://spec.matrix.org/v1.2/client-server-api/#mroommessage-msgtypes
+var allowedTags = map[string][]string{
+	"font":       {"data-mx-bg-color", "data-mx-color", "color"},
+	"del":        nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"blockquote": nil,
+	"p":          nil,
+	"a":          {"name", "target", "href"},
+	"ul":         nil,
+	"ol":         {"start"},
+	"sup":        nil,
+	"sub":        nil,
+	"li":         nil,
+	"b":          nil,
+	"i":          nil,
+	"u":          nil,
+	"strong":     nil,
+	"em":         nil,
+	"strike":     nil,
+	"code":       {"class"},
+	"hr":         nil,
+	"br":         nil,
+	"div":        nil,
+	"table":      nil,
+	"thead":      nil,
+	"tbody":      nil,
+	"tr":         nil,
+	"th":         nil,
+	"td":         nil,
+	"caption":    nil,
+	"pre":        nil,
+	"span":       {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler"},
+	"img":        {"width", "height", "alt", "title", "src"},
+	"details":    nil,
+	"summary":    nil,
+}
+
+//tags which get replaced by an allowed equivalent
+var replacedTags = map[string]string{
+	"center":  "div",
+	"section": "div",
+	"article": "div",
+	"header":  "div",
+	"footer":  "div",
+	"main":    "div",
+	"nav":     "div",
+	"aside":   "div",
+	"address": "div",
+	"dl":      "div",
+	"dt":      "b",
+	"dd":      "blockquote",
+	"tfoot":   "tbody",
+	"s":       "strike",
+	"ins":     "u",
+	"tt":      "code",
+	"kbd":     "code",
+	"samp":    "code",
+	"var":     "i",
+	"cite":    "i",
+	"dfn":     "i",
+	"mark":    "span",
+	"big":     "span",
+	"small":   "span",
+}
+
+//tags which get dropped together with their content
+var droppedTags = map[string]bool{
+	"head":     true,
+	"title":    true,
+	"meta":     true,
+	"link":     true,
+	"style":    true,
+	"script":   true,
+	"noscript": true,
+	"template": true,
+	"iframe":   true,
+	"frame":    true,
+	"object":   true,
+	"embed":    true,
+	"applet":   true,
+	"svg":      true,
+	"math":     true,
+	"input":    true,
+	"button":   true,
+	"select":   true,
+	"textarea": true,
+	"audio":    true,
+	"video":    true,
+	"canvas":   true,
+	"map":      true,
+}
+
+var allowedSchemes = []string{"http://", "https://", "ftp://", "mailto:", "magnet:"}
+
+var styleColorRegex = regexp.MustCompile(`(?i)(^|;)\s*(background-color|background|color)\s*:\s*(#[0-9a-f]{6}|#[0-9a-f]{3})\b`)
+var whitespaceRegex = regexp.MustCompile(`[ \t\r\n\f]+`)
+var emptyLinesRegex = regexp.MustCompile(`\n{3,}`)
+
+//sanitizeHTML reduces htmlBody to the HTML subset supported by matrix clients.
+//It returns the sanitized HTML and a plaintext version generated from the same tree
+func sanitizeHTML(htmlBody string) (formatted, plain string) {
+	doc, err := html.Parse(strings.NewReader(htmlBody))
+	if err != nil {
+		WriteLog(logError, "#79 sanitizeHTML parse: "+err.Error())
+		return html.EscapeString(htmlBody), htmlBody
+	}
+
+	root := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	sanitizeChildren(doc, root, false)
+
+	var formattedBuilder strings.Builder
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		html.Render(&formattedBuilder, c)
+	}
+
+	var plainBuilder strings.Builder
+	renderPlain(root, &plainBuilder)
+	plain = strings.TrimSpace(emptyLinesRegex.ReplaceAllString(trimLines(plainBuilder.String()), "\n\n"))
+
+	return strings.TrimSpace(formattedBuilder.String()), plain
+}
+
+//sanitizeChildren appends sanitized copies of the children of src to dst
+func sanitizeChildren(src, dst *html.Node, inPre bool) {
+	for c := src.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			text := c.Data
+			if !inPre {
+				text = whitespaceRegex.ReplaceAllString(text, " ")
+			}
+			dst.AppendChild(&html.Node{Type: html.TextNode, Data: text})
+		case html.ElementNode:
+			sanitizeElement(c, dst, inPre)
+		case html.DocumentNode:
+			sanitizeChildren(c, dst, inPre)
+		}
+	}
+}
+
+func sanitizeElement(src, dst *html.Node, inPre bool) {
+	tag := strings.ToLower(src.Data)
+	if droppedTags[tag] {
+		return
+	}
+	if newTag, ok := replacedTags[tag]; ok {
+		tag = newTag
+	}
+
+	allowedAttrs, ok := allowedTags[tag]
+	if !ok {
+		//unknown tags get unwrapped
+		sanitizeChildren(src, dst, inPre)
+		return
+	}
+
+	node := &html.Node{Type: html.ElementNode, Data: tag, DataAtom: atom.Lookup([]byte(tag))}
+	for _, attr := range src.Attr {
+		key := strings.ToLower(attr.Key)
+		if !contains(allowedAttrs, key) {
+			continue
+		}
+		switch {
+		case tag == "a" && key == "href":
+			if !hasAllowedScheme(attr.Val) {
+				continue
+			}
+		case tag == "img" && key == "src":
+			if !strings.HasPrefix(attr.Val, "mxc://") {
+				continue
+			}
+		case tag == "code" && key == "class":
+			if !strings.HasPrefix(attr.Val, "language-") {
+				continue
+			}
+		}
+		node.Attr = append(node.Attr, html.Attribute{Key: key, Val: attr.Val})
+	}
+
+	if tag == "font" || tag == "span" {
+		node.Attr = append(node.Attr, styleToColorAttrs(getAttr(src, "style"))...)
+	}
+
+	if tag == "img" && len(getAttr(node, "src")) == 0 {
+		//external images can't be displayed, link them instead
+		alt := strings.TrimSpace(getAttr(src, "alt"))
+		srcURL := getAttr(src, "src")
+		if len(alt) == 0 {
+			return
+		}
+		if hasAllowedScheme(srcURL) {
+			link := &html.Node{Type: html.ElementNode, Data: "a", DataAtom: atom.A, Attr: []html.Attribute{{Key: "href", Val: srcURL}}}
+			link.AppendChild(&html.Node{Type: html.TextNode, Data: alt})
+			dst.AppendChild(link)
+		} else {
+			dst.AppendChild(&html.Node{Type: html.TextNode, Data: alt})
+		}
+		return
+	}
+
+	sanitizeChildren(src, node, inPre || tag == "pre")
+	dst.AppendChild(node)
+}
+
+//styleToColorAttrs converts css colors to the matrix color attributes
+func styleToColorAttrs(style string) []html.Attribute {
+	var attrs []html.Attribute
+	for _, match := range styleColorRegex.FindAllStringSubmatch(style, -1) {
+		key := "data-mx-color"
+		if strings.HasPrefix(strings.ToLower(match[2]), "background") {
+			key = "data-mx-bg-color"
+		}
+		attrs = append(attrs, html.Attribute{Key: key, Val: match[3]})
+	}
+	return attrs
+}
+
+func hasAllowedScheme(link string) bool {
+	link = strings.ToLower(strings.TrimSpace(link))
+	for _, scheme := range allowedSchemes {
+		if strings.HasPrefix(link, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func getAttr(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if strings.ToLower(attr.Key) == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+//renderPlain writes a readable plaintext version of a sanitized tree
+func renderPlain(node *html.Node, sb *strings.Builder) {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			sb.WriteString(c.Data)
+			continue
+		}
+		switch c.Data {
+		case "br":
+			sb.WriteString("\n")
+		case "hr":
+			sb.WriteString("\n────────────────────\n")
+		case "img":
+			sb.WriteString("[" + getAttr(c, "alt") + "]")
+		case "li":
+			sb.WriteString("\n- ")
+			renderPlain(c, sb)
+		case "td", "th":
+			renderPlain(c, sb)
+			sb.WriteString("\t")
+		case "a":
+			var linkText strings.Builder
+			renderPlain(c, &linkText)
+			sb.WriteString(linkText.String())
+			href := getAttr(c, "href")
+			if len(href) > 0 && strings.TrimSpace(linkText.String()) != strings.TrimPrefix(href, "mailto:") && strings.TrimSpace(linkText.String()) != href {
+				sb.WriteString(" (" + href + ")")
+			}
+		case "blockquote":
+			var quote strings.Builder
+			renderPlain(c, &quote)
+			sb.WriteString("\n")
+			for _, line := range strings.Split(strings.TrimSpace(trimLines(quote.String())), "\n") {
+				sb.WriteString("> " + line + "\n")
+			}
+		case "p", "div", "h1", "h2", "h3", "h4", "h5", "h6", "ul", "ol", "table", "tr", "pre", "caption", "details", "summary":
+			sb.WriteString("\n")
+			renderPlain(c, sb)
+			sb.WriteString("\n")
+		default:
+			renderPlain(c, sb)
+		}
+	}
+}
+
+//trimLines removes leading and trailing spaces of every line
+func trimLines(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Trim(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"allowed tags are kept", `<p>Hello <b>bold</b> <i>italic</i></p>`, `<p>Hello <b>bold</b> <i>italic</i></p>`},
+		{"dropped tags lose their content", `<head><title>t</title><style>p{}</style></head><body><script>alert(1)</script>text</body>`, `text`},
+		{"unknown tags are unwrapped", `<custom><b>a</b></custom>`, `<b>a</b>`},
+		{"replaced tags", `<center><s>old</s></center>`, `<div><strike>old</strike></div>`},
+		{"disallowed attributes are removed", `<p onclick="x()" class="c">a</p>`, `<p>a</p>`},
+		{"links with allowed schemes", `<a href="https://example.org" onclick="x()">a</a>`, `<a href="https://example.org">a</a>`},
+		{"javascript links lose their href", `<a href="javascript:alert(1)">a</a>`, `<a>a</a>`},
+		{"mxc images are kept", `<img src="mxc://example.org/abc" alt="pic">`, `<img src="mxc://example.org/abc" alt="pic"/>`},
+		{"external images are linked", `<img src="https://example.org/pic.png" alt="pic">`, `<a href="https://example.org/pic.png">pic</a>`},
+		{"external images without alt are removed", `<img src="https://example.org/pic.png">`, ``},
+		{"colors become matrix attributes", `<span style="color: #ff0000; background-color:#00f">red</span>`, `<span data-mx-color="#ff0000" data-mx-bg-color="#00f">red</span>`},
+		{"code language class", `<code class="language-go">x</code><code class="evil">y</code>`, `<code class="language-go">x</code><code>y</code>`},
+		{"whitespace outside pre is collapsed", "<p>a\n\n   b</p><pre>c\n  d</pre>", "<p>a b</p><pre>c\n  d</pre>"},
+	}
+	for _, test := range tests {
+		if formatted, _ := sanitizeHTML(test.input); formatted != test.want {
+			t.Errorf("%s: sanitizeHTML(%q) = %q, want %q", test.name, test.input, formatted, test.want)
+		}
+	}
+}
+
+func TestSanitizeHTMLPlain(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"paragraphs and line breaks", `<p>first</p><p>second<br>line</p>`, "first\n\nsecond\nline"},
+		{"lists", `<ul><li>one</li><li>two</li></ul>`, "- one\n- two"},
+		{"links show their target", `<a href="https://example.org">site</a> <a href="https://example.org">https://example.org</a> <a href="mailto:a@b.de">a@b.de</a>`, "site (https://example.org) https://example.org a@b.de"},
+		{"quotes", `<blockquote><p>quoted</p>text</blockquote>`, "> quoted\n> text"},
+		{"images show their alt text", `<img src="mxc://example.org/abc" alt="pic">`, "[pic]"},
+		{"tables", `<table><tr><td>a</td><td>b</td></tr></table>`, "a\tb"},
+		{"dropped content isn't shown", `<style>p{}</style><p>text</p>`, "text"},
+	}
+	for _, test := range tests {
+		if _, plain := sanitizeHTML(test.input); plain != test.want {
+			t.Errorf("%s: plain of %q = %q, want %q", test.name, test.input, plain, test.want)
+		}
+	}
+}
@@ -1,82 +1,244 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html"
 	"io"
 	"io/ioutil"
 	"log"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"net"
+	"net/smtp"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	imapCommands "github.com/emersion/go-imap/commands"
 	_ "github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
+	"github.com/gomarkdown/markdown"
 	strip "github.com/grokify/html-strip-tags-go"
+	"gopkg.in/gomail.v2"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
 )
 
-func loginMail(host, username, password string, ignoreSSL bool) (*client.Client, error) {
-	ailClient, err := client.DialTLS(host, &tls.Config{InsecureSkipVerify: ignoreSSL})
+func loginMail(account *imapAccountount) (*client.Client, error) {
+	host := account.host
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: account.ignoreSSL, ServerName: hostname}
+
+	var ailClient *client.Client
+	switch account.security {
+	case securityStartTLS:
+		ailClient, err = client.Dial(host)
+		if err != nil {
+			return nil, err
+		}
+		if ok, _ := ailClient.SupportStartTLS(); !ok {
+			ailClient.Logout()
+			return nil, errors.New("the server doesn't support STARTTLS")
+		}
+		if err = ailClient.StartTLS(tlsConfig); err != nil {
+			ailClient.Logout()
+			return nil, err
+		}
+	case securityPlain:
+		if !isLoopbackHost(hostname) {
+			return nil, errors.New("unencrypted connections are only allowed to localhost")
+		}
+		ailClient, err = client.Dial(host)
+	default:
+		ailClient, err = client.DialTLS(host, tlsConfig)
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	if err := ailClient.Login(username, password); err != nil {
+	if account.authMethod == authXOAuth2 || account.authMethod == authOAuthBearer {
+		saslClient, err := newSASLClient(account.authMethod, account.username, account.oauthToken, host)
+		if err != nil {
+			ailClient.Logout()
+			return nil, err
+		}
+		if err := ailClient.Authenticate(saslClient); err != nil {
+			ailClient.Logout()
+			return nil, err
+		}
+		return ailClient, nil
+	}
+
+	if err := ailClient.Login(account.username, account.password); err != nil {
 		return nil, err
 	}
 
 	return ailClient, nil
 }
 
-func getMails(mClient *client.Client, mBox string, messages chan *imap.Message) (*imap.BodySectionName, int) {
-	mbox, err := mClient.Select(mBox, false)
+//isLoopbackHost returns true if hostname refers to the local machine
+func isLoopbackHost(hostname string) bool {
+	if strings.ToLower(hostname) == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+//parseSecurity parses the security mode of a mail account
+func parseSecurity(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case securityTLS, "ssl":
+		return securityTLS, nil
+	case securityStartTLS:
+		return securityStartTLS, nil
+	case securityPlain, "none":
+		return securityPlain, nil
+	}
+	return "", errors.New("unknown security mode '" + mode + "'. Use tls, starttls or plain")
+}
+
+//getMails fetches all messages newer than the last bridged UID of the mailbox (at most maxCatchUp).
+//If the UIDVALIDITY of the mailbox changed, the bridge resyncs and only new messages get bridged
+func getMails(mClient *client.Client, account *imapAccountount, messages chan *imap.Message) (section *imap.BodySectionName, uidValidity, lastUID uint32, errCode int) {
+	mbox, err := mClient.Select(account.mailbox, false)
 	if err != nil {
 		WriteLog(logError, "#12 couldnt get INBOX "+err.Error())
-		return nil, 0
+		return nil, 0, 0, 0
 	}
 
 	if mbox == nil {
 		WriteLog(logError, "#23 getMails mbox is nli")
-		return nil, 0
+		return nil, 0, 0, 0
 	}
 
-	if mbox.Messages == 0 {
-		WriteLog(logError, "#13 getMails no messages in inbox ")
-		return nil, 1
+	uidValidity, lastUID, found, err := getMailboxState(account.roomPKID, account.mailbox)
+	if err != nil {
+		WriteLog(critical, "#66 getMailboxState: "+err.Error())
+		return nil, 0, 0, 0
+	}
+
+	if !found || uidValidity != mbox.UidValidity {
+		if found {
+			WriteLog(info, "UIDVALIDITY of "+account.mailbox+" ("+account.username+") changed. Resyncing")
+			sendNotice(id.RoomID(account.roomID), "The mailbox "+account.mailbox+" was reset by the mailserver. Only new emails will be bridged from now on")
+		}
+		lastUID, err = getHighestUID(mClient, mbox)
+		if err != nil {
+			WriteLog(logError, "#67 getHighestUID: "+err.Error())
+			return nil, 0, 0, 0
+		}
+		err = saveMailboxState(account.roomPKID, account.mailbox, mbox.UidValidity, lastUID)
+		if err != nil {
+			WriteLog(critical, "#68 saveMailboxState: "+err.Error())
+			return nil, 0, 0, 0
+		}
+		return nil, mbox.UidValidity, lastUID, 1
+	}
+
+	if mbox.Messages == 0 || (mbox.UidNext > 0 && mbox.UidNext <= lastUID+1) {
+		return nil, uidValidity, lastUID, 1
 	}
 
 	seqSet := new(imap.SeqSet)
-	maxMessages := uint32(5)
-	if mbox.Messages < maxMessages {
-		maxMessages = mbox.Messages
+	seqSet.AddRange(lastUID+1, 0)
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = seqSet
+	uids, err := mClient.UidSearch(criteria)
+	if err != nil {
+		WriteLog(logError, "#72 UidSearch: "+err.Error())
+		return nil, 0, 0, 0
+	}
+
+	var newUIDs []uint32
+	for _, uid := range uids {
+		if uid > lastUID {
+			newUIDs = append(newUIDs, uid)
+		}
 	}
-	for i := uint32(0); i < maxMessages; i++ {
-		seqSet.AddNum(mbox.Messages - i)
+	if len(newUIDs) == 0 {
+		return nil, uidValidity, lastUID, 1
 	}
+	sort.Slice(newUIDs, func(i, j int) bool { return newUIDs[i] < newUIDs[j] })
+
+	if account.maxCatchUp > 0 && len(newUIDs) > account.maxCatchUp {
+		skipped := len(newUIDs) - account.maxCatchUp
+		newUIDs = newUIDs[skipped:]
+		if !account.silence {
+			sendNotice(id.RoomID(account.roomID), strconv.Itoa(skipped)+" older messages skipped")
+		}
+	}
+
+	seqSet = new(imap.SeqSet)
+	seqSet.AddNum(newUIDs...)
 
-	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+	//with read sync enabled, emails stay unseen until they get read in matrix
+	readSync, err := isReadSyncEnabled(account.roomID)
+	if err != nil {
+		WriteLog(critical, "#89 isReadSyncEnabled: "+err.Error())
+	}
+	section = &imap.BodySectionName{Peek: readSync}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
 	go func() {
-		if err := mClient.Fetch(seqSet, items, messages); err != nil {
+		if err := mClient.UidFetch(seqSet, items, messages); err != nil {
 			WriteLog(critical, "#14 couldnt fetch messages: "+err.Error())
 		}
 	}()
-	return section, -1
+	return section, uidValidity, lastUID, -1
+}
+
+//getHighestUID returns the UID of the newest message in the selected mailbox
+func getHighestUID(mClient *client.Client, mbox *imap.MailboxStatus) (uint32, error) {
+	if mbox.UidNext > 0 {
+		return mbox.UidNext - 1, nil
+	}
+	if mbox.Messages == 0 {
+		return 0, nil
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(mbox.Messages)
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- mClient.Fetch(seqSet, []imap.FetchItem{imap.FetchUid}, messages)
+	}()
+	var uid uint32
+	for msg := range messages {
+		uid = msg.Uid
+	}
+	return uid, <-done
 }
 
 type email struct {
-	body, from, to, subject, attachment string
-	sendermails                         []string
-	date                                time.Time
-	htmlFormat                          bool
+	body, formattedBody, from, to, subject string
+	messageID, replyTo, senderName         string
+	sendermails, references, inReplyTo     []string
+	attachments                            []mailAttachment
+	date                                   time.Time
+	htmlFormat                             bool
 }
 
-func getMailboxes(emailClient *client.Client) (string, error) {
+type mailAttachment struct {
+	filename, mimeType string
+	data               []byte
+	tooLarge           bool
+}
+
+func getMailboxes(emailClient *client.Client) ([]string, error) {
 	// List mailboxes
 	mailboxes := make(chan *imap.MailboxInfo, 20)
 	done := make(chan error, 1)
@@ -84,17 +246,358 @@ func getMailboxes(emailClient *client.Client) (string, error) {
 		done <- emailClient.List("", "*", mailboxes)
 	}()
 
-	mboxes := ""
+	var mboxes []string
 	for m := range mailboxes {
-		mboxes += "-> " + m.Name + "\r\n"
+		mboxes = append(mboxes, m.Name)
 	}
 
 	if err := <-done; err != nil {
-		return "", err
+		return nil, err
 	}
 	return mboxes, nil
 }
 
+//runOnBridgedMail selects the mailbox of a bridged email and runs fn with a set containing its UID
+func runOnBridgedMail(roomID string, mail *bridgedMail, fn func(c *client.Client, uidSet *imap.SeqSet) error) error {
+	if mail.uid == 0 {
+		return errors.New("this message is not an email on your imap server")
+	}
+	return runOnMailClient(roomID, func(c *client.Client) error {
+		mbox, err := c.Select(mail.mailbox, false)
+		if err != nil {
+			return err
+		}
+		if mbox.UidValidity != mail.uidValidity {
+			return errors.New("the mailbox " + mail.mailbox + " was reset by the mailserver")
+		}
+		uidSet := new(imap.SeqSet)
+		uidSet.AddNum(mail.uid)
+		return fn(c, uidSet)
+	})
+}
+
+//markMailsSeen sets the \Seen flag of all bridged emails of a room up to and including the one bridged as eventID
+func markMailsSeen(roomID, eventID string) {
+	mails, err := getUnseenMails(roomID, eventID)
+	if err != nil {
+		WriteLog(logError, "#88 getUnseenMails: "+err.Error())
+		return
+	}
+	if len(mails) == 0 {
+		return
+	}
+
+	type mailboxVersion struct {
+		mailbox     string
+		uidValidity uint32
+	}
+	uidSets := make(map[mailboxVersion]*imap.SeqSet)
+	for _, mail := range mails {
+		key := mailboxVersion{mail.mailbox, mail.uidValidity}
+		if uidSets[key] == nil {
+			uidSets[key] = new(imap.SeqSet)
+		}
+		uidSets[key].AddNum(mail.uid)
+	}
+
+	err = runOnMailClient(roomID, func(c *client.Client) error {
+		for key, uidSet := range uidSets {
+			mbox, err := c.Select(key.mailbox, false)
+			if err != nil {
+				return err
+			}
+			if mbox.UidValidity != key.uidValidity {
+				//the emails can't be found anymore
+				continue
+			}
+			err = c.UidStore(uidSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		WriteLog(logError, "#90 markMailsSeen: "+err.Error())
+		return
+	}
+	if err = setMailsSeen(roomID, eventID); err != nil {
+		WriteLog(logError, "#150 setMailsSeen: "+err.Error())
+	}
+}
+
+//searchResult is the result of the last !search of a room
+type searchResult struct {
+	mailbox     string
+	uidValidity uint32
+	uids        []uint32
+}
+
+var searchResults = make(map[string]*searchResult)
+var searchResultsMutex sync.Mutex
+
+const maxSearchResults = 20
+
+//parseSearchQuery translates a search query like 'from:bob subject:"my mail" since:2022-01-31 unseen hello' into imap search criteria
+func parseSearchQuery(query string) (*imap.SearchCriteria, error) {
+	criteria := imap.NewSearchCriteria()
+	for _, token := range splitQuery(query) {
+		key, value, hasValue := strings.Cut(token, ":")
+		key = strings.ToLower(key)
+		switch {
+		case token == "unseen":
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+		case token == "seen":
+			criteria.WithFlags = append(criteria.WithFlags, imap.SeenFlag)
+		case hasValue && (key == "from" || key == "to" || key == "cc" || key == "subject"):
+			criteria.Header.Add(key, value)
+		case hasValue && (key == "since" || key == "before"):
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return nil, errors.New("invalid date " + value + ", use YYYY-MM-DD")
+			}
+			if key == "since" {
+				criteria.Since = date
+			} else {
+				criteria.Before = date
+			}
+		default:
+			criteria.Text = append(criteria.Text, token)
+		}
+	}
+	return criteria, nil
+}
+
+//splitQuery splits a query by spaces, text in quotes is kept together
+func splitQuery(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ' ' && !inQuotes:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+//searchMails searches the mailbox of a room and returns an overview of the newest results
+func searchMails(roomID, mailbox string, criteria *imap.SearchCriteria) (result *searchResult, overview []*imap.Message, err error) {
+	err = runOnMailClient(roomID, func(c *client.Client) error {
+		mbox, err := c.Select(mailbox, true)
+		if err != nil {
+			return err
+		}
+		uids, err := c.UidSearch(criteria)
+		if err != nil {
+			return err
+		}
+		sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+		if len(uids) > maxSearchResults {
+			uids = uids[:maxSearchResults]
+		}
+		result = &searchResult{mailbox, mbox.UidValidity, uids}
+		if len(uids) == 0 {
+			return nil
+		}
+
+		uidSet := new(imap.SeqSet)
+		uidSet.AddNum(uids...)
+		messages := make(chan *imap.Message, len(uids))
+		err = c.UidFetch(uidSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+		if err != nil {
+			return err
+		}
+		byUID := make(map[uint32]*imap.Message)
+		for msg := range messages {
+			byUID[msg.Uid] = msg
+		}
+		for _, uid := range uids {
+			if msg, ok := byUID[uid]; ok {
+				overview = append(overview, msg)
+			}
+		}
+		result.uids = nil
+		for _, msg := range overview {
+			result.uids = append(result.uids, msg.Uid)
+		}
+		return nil
+	})
+	return
+}
+
+//fetchSearchResult fetches the complete email of a search result
+func fetchSearchResult(roomID string, result *searchResult, uid uint32) (msg *imap.Message, section *imap.BodySectionName, err error) {
+	err = runOnMailClient(roomID, func(c *client.Client) error {
+		mbox, err := c.Select(result.mailbox, true)
+		if err != nil {
+			return err
+		}
+		if mbox.UidValidity != result.uidValidity {
+			return errors.New("the mailbox " + result.mailbox + " was reset by the mailserver, please search again")
+		}
+		uidSet := new(imap.SeqSet)
+		uidSet.AddNum(uid)
+		section = &imap.BodySectionName{Peek: true}
+		messages := make(chan *imap.Message, 1)
+		err = c.UidFetch(uidSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}, messages)
+		if err != nil {
+			return err
+		}
+		msg = <-messages
+		if msg == nil {
+			return errors.New("the email doesn't exist anymore")
+		}
+		return nil
+	})
+	return
+}
+
+//moveMail moves a bridged email into another mailbox
+func moveMail(roomID string, mail *bridgedMail, mailbox string) error {
+	err := runOnBridgedMail(roomID, mail, func(c *client.Client, uidSet *imap.SeqSet) error {
+		return moveMessages(c, uidSet, mailbox)
+	})
+	if err != nil {
+		return err
+	}
+	return forgetMailUID(mail)
+}
+
+//getArchiveMailbox returns the archive mailbox of the imap account of a room
+func getArchiveMailbox(roomID string) (archive string, err error) {
+	err = runOnMailClient(roomID, func(c *client.Client) error {
+		archive, err = findSpecialMailbox(c, imap.ArchiveAttr, []string{"Archive", "Archives", "INBOX.Archive", "[Gmail]/All Mail"})
+		return err
+	})
+	return
+}
+
+//deleteRedactedMail moves a bridged email to the trash or deletes it, depending on the settings of the room
+func deleteRedactedMail(roomID string, mail *bridgedMail) {
+	action, err := getRedactAction(roomID)
+	if err != nil {
+		WriteLog(critical, "#94 getRedactAction: "+err.Error())
+		return
+	}
+	if action == redactActionOff {
+		return
+	}
+	err = runOnBridgedMail(roomID, mail, func(c *client.Client, uidSet *imap.SeqSet) error {
+		if action == redactActionDelete {
+			return deleteMail(c, uidSet)
+		}
+		trash, err := findSpecialMailbox(c, imap.TrashAttr, []string{"Trash", "Deleted Items", "Deleted Messages", "INBOX.Trash"})
+		if err != nil {
+			return err
+		}
+		if trash == mail.mailbox {
+			//the email is in the trash already
+			if hasUIDPlus, _ := c.Support("UIDPLUS"); !hasUIDPlus {
+				return nil
+			}
+			return deleteMail(c, uidSet)
+		}
+		return moveMessages(c, uidSet, trash)
+	})
+	if err != nil {
+		WriteLog(logError, "#95 deleteRedactedMail: "+err.Error())
+		sendNotice(id.RoomID(roomID), "Couldn't delete the email \""+mail.subject+"\": "+err.Error())
+		return
+	}
+	err = forgetMailUID(mail)
+	if err != nil {
+		WriteLog(logError, "#96 forgetMailUID: "+err.Error())
+	}
+}
+
+//moveMessages moves the messages to dest. Without MOVE they are copied and deleted
+func moveMessages(c *client.Client, uidSet *imap.SeqSet, dest string) error {
+	if hasMove, _ := c.Support("MOVE"); hasMove {
+		return c.UidMove(uidSet, dest)
+	}
+	//the fallback of UidMove expunges all messages flagged as deleted
+	if hasUIDPlus, _ := c.Support("UIDPLUS"); !hasUIDPlus {
+		return errors.New("the mailserver can't move single emails (no MOVE or UIDPLUS support)")
+	}
+	if err := c.UidCopy(uidSet, dest); err != nil {
+		return err
+	}
+	return deleteMail(c, uidSet)
+}
+
+var errNoUIDPlus = errors.New("the mailserver can't delete single emails (no UIDPLUS support). Use !setredact trash to move them to the trash instead")
+
+//deleteMail flags the messages as deleted and expunges them.
+//Only UID EXPUNGE (UIDPLUS) removes just the given messages, EXPUNGE would remove all messages flagged as deleted
+func deleteMail(c *client.Client, uidSet *imap.SeqSet) error {
+	if hasUIDPlus, _ := c.Support("UIDPLUS"); !hasUIDPlus {
+		return errNoUIDPlus
+	}
+	err := c.UidStore(uidSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+	if err != nil {
+		return err
+	}
+	status, err := c.Execute(&imapCommands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{uidSet}}}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+//findSpecialMailbox returns the mailbox with the given special-use attribute.
+//If the server doesn't support special-use attributes, the first existing mailbox of names is returned
+func findSpecialMailbox(c *client.Client, attr string, names []string) (string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 20)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+
+	var found string
+	existing := make(map[string]string)
+	for m := range mailboxes {
+		for _, mAttr := range m.Attributes {
+			if strings.EqualFold(mAttr, attr) && len(found) == 0 {
+				found = m.Name
+			}
+		}
+		existing[strings.ToLower(m.Name)] = m.Name
+	}
+	if err := <-done; err != nil {
+		return "", err
+	}
+	if len(found) > 0 {
+		return found, nil
+	}
+	for _, name := range names {
+		if mailbox, ok := existing[strings.ToLower(name)]; ok {
+			return mailbox, nil
+		}
+	}
+	return "", errors.New("couldn't find a " + strings.TrimPrefix(attr, "\\") + " mailbox")
+}
+
+//getRoomMailboxes lists the mailboxes using the imap connection of the room
+func getRoomMailboxes(roomID string) (mailboxes []string, err error) {
+	err = runOnMailClient(roomID, func(c *client.Client) error {
+		mailboxes, err = getMailboxes(c)
+		return err
+	})
+	return
+}
+
 func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID string) *email {
 	if msg == nil {
 		fmt.Println("msg is nil")
@@ -127,6 +630,9 @@ func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID str
 		for i, sender := range from {
 			if len(sender.Name) > 0 {
 				list[i] = sender.Name + "<" + sender.Address + ">"
+				if len(jmail.senderName) == 0 {
+					jmail.senderName = sender.Name
+				}
 			} else {
 				list[i] = sender.Address
 			}
@@ -149,9 +655,27 @@ func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID str
 		log.Println("Subject:", subject)
 		jmail.subject = subject
 	}
+	if messageID, err := header.MessageID(); err == nil {
+		jmail.messageID = messageID
+	}
+	if references, err := header.MsgIDList("References"); err == nil {
+		jmail.references = references
+	}
+	if inReplyTo, err := header.MsgIDList("In-Reply-To"); err == nil {
+		jmail.inReplyTo = inReplyTo
+	}
+	if replyTo, err := header.AddressList("Reply-To"); err == nil && len(replyTo) > 0 {
+		jmail.replyTo = replyTo[0].Address
+	}
+
+	maxAttachmentSize, err := getMaxAttachmentSize(roomID)
+	if err != nil {
+		WriteLog(critical, "#74 getMaxAttachmentSize: "+err.Error())
+		maxAttachmentSize = defaultMaxAttachmentSize()
+	}
 
 	htmlBody, plainBody := "", ""
-	_ = htmlBody
+	inlineParts := make(map[string]mailAttachment)
 	for {
 		p, err := mr.NextPart()
 		if err == io.EOF {
@@ -177,10 +701,34 @@ func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID str
 				continue
 			}
 
+			if contentID := strings.Trim(p.Header.Get("Content-Id"), "<> "); len(contentID) > 0 {
+				mimeType, _, _ := h.ContentType()
+				inlineParts[contentID] = mailAttachment{filename: contentID, mimeType: mimeType, data: b}
+				continue
+			}
+
 			plainBody = bodycontent
 		case *mail.AttachmentHeader:
 			filename, _ := h.Filename()
-			jmail.attachment += string(filename) + "\r\n"
+			if len(filename) == 0 {
+				filename = "attachment"
+			}
+			mimeType, _, _ := h.ContentType()
+			if len(mimeType) == 0 {
+				mimeType = "application/octet-stream"
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(p.Body, maxAttachmentSize+1))
+			if err != nil {
+				WriteLog(logError, "#73 getMailContent read attachment err: "+err.Error())
+				continue
+			}
+			attachment := mailAttachment{filename: filename, mimeType: mimeType}
+			if int64(len(data)) > maxAttachmentSize {
+				attachment.tooLarge = true
+			} else {
+				attachment.data = data
+			}
+			jmail.attachments = append(jmail.attachments, attachment)
 		}
 	}
 	isEnabled, eror := isHTMLenabled(roomID)
@@ -188,13 +736,22 @@ func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID str
 		WriteLog(critical, "#55 isHTMLenabled: "+eror.Error())
 	}
 	if len(htmlBody) > 0 && isEnabled {
-		jmail.body = html.UnescapeString(htmlBody)
+		if store.IsEncrypted(id.RoomID(roomID)) {
+			//encrypted uploads can't be embedded into html, so inline images are sent as attachments
+			for _, part := range inlineParts {
+				jmail.attachments = append(jmail.attachments, part)
+			}
+		} else {
+			htmlBody = replaceInlineImages(htmlBody, inlineParts)
+		}
+		jmail.formattedBody, jmail.body = sanitizeHTML(htmlBody)
 		jmail.htmlFormat = true
 	} else {
-		if len(strings.Trim(plainBody, " ")) == 0 {
-			plainBody = htmlBody
+		if len(strings.TrimSpace(plainBody)) == 0 {
+			_, plainBody = sanitizeHTML(htmlBody)
+		} else {
+			parseMailBody(&plainBody)
 		}
-		parseMailBody(&plainBody)
 		jmail.body = plainBody
 		jmail.htmlFormat = false
 	}
@@ -202,6 +759,250 @@ func getMailContent(msg *imap.Message, section *imap.BodySectionName, roomID str
 	return &jmail
 }
 
+//replaceInlineImages uploads all inline parts referenced by a cid: URL
+//and replaces the references with the mxc:// URI of the upload
+func replaceInlineImages(htmlBody string, inlineParts map[string]mailAttachment) string {
+	for contentID, part := range inlineParts {
+		refs := []string{"cid:" + contentID, "cid:" + url.PathEscape(contentID)}
+		if !strings.Contains(htmlBody, refs[0]) && !strings.Contains(htmlBody, refs[1]) {
+			continue
+		}
+		resp, err := matrixClient.UploadBytesWithName(part.data, part.mimeType, part.filename)
+		if err != nil {
+			WriteLog(logError, "#78 upload inline part: "+err.Error())
+			continue
+		}
+		for _, ref := range refs {
+			htmlBody = strings.ReplaceAll(htmlBody, ref, resp.ContentURI.String())
+		}
+	}
+	return htmlBody
+}
+
+//sendAttachment uploads an attachment to the media repo (encrypted in encrypted rooms) and posts it into the room
+func sendAttachment(roomID string, attachment mailAttachment, threadRoot id.EventID, puppet *appservice.IntentAPI) id.EventID {
+	if attachment.tooLarge {
+		sendNotice(id.RoomID(roomID), "The attachment "+attachment.filename+" is too large to be bridged")
+		return ""
+	}
+	contentURI, file, err := uploadMedia(id.RoomID(roomID), attachment.data, attachment.mimeType, attachment.filename)
+	if err != nil {
+		WriteLog(logError, "#75 uploadMedia: "+err.Error())
+		sendNotice(id.RoomID(roomID), "Couldn't upload attachment "+attachment.filename+": "+err.Error())
+		return ""
+	}
+
+	msgType := event.MsgFile
+	switch strings.Split(attachment.mimeType, "/")[0] {
+	case "image":
+		msgType = event.MsgImage
+	case "video":
+		msgType = event.MsgVideo
+	case "audio":
+		msgType = event.MsgAudio
+	}
+	content := &event.MessageEventContent{
+		MsgType: msgType,
+		Body:    attachment.filename,
+		URL:     contentURI,
+		File:    file,
+		Info: &event.FileInfo{
+			MimeType: attachment.mimeType,
+			Size:     len(attachment.data),
+		},
+		RelatesTo: threadRelation(threadRoot),
+	}
+	sendResp, err := sendMessageEventAs(puppet, id.RoomID(roomID), event.EventMessage, content)
+	if err != nil {
+		WriteLog(logError, "#82 send attachment: "+err.Error())
+		return ""
+	}
+	return sendResp.EventID
+}
+
+var subjectPrefixRegex = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|wg|sv|antw)(\[\d+\])?\s*:\s*)+`)
+
+//normalizeSubject removes reply and forward prefixes so that all emails of a conversation have the same subject
+func normalizeSubject(subject string) string {
+	subject = subjectPrefixRegex.ReplaceAllString(subject, "")
+	return strings.ToLower(strings.Join(strings.Fields(subject), " "))
+}
+
+//threadRelation returns the relation which puts an event into the thread of threadRoot
+func threadRelation(threadRoot id.EventID) *event.RelatesTo {
+	if len(threadRoot) == 0 {
+		return nil
+	}
+	return &event.RelatesTo{Type: relThread, EventID: threadRoot}
+}
+
+//generateMessageID generates a new Message-ID for an email sent by from
+func generateMessageID(from string) string {
+	domain := "matrix-emailbridge"
+	if _, host, ok := strings.Cut(from, "@"); ok && len(host) > 0 {
+		domain = host
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "." + hex.EncodeToString(random) + "@" + domain
+}
+
+//markdownToHTML converts the markdown body of an email into its HTML part
+func markdownToHTML(body string) string {
+	toSendText := string(markdown.ToHTML([]byte(body), nil, nil))
+	toSendText = strings.ReplaceAll(toSendText, "\r\n<h", "<h")
+	toSendText = strings.ReplaceAll(toSendText, "\n\n<h", "<h")
+	toSendText = strings.ReplaceAll(toSendText, ">\n\n", ">")
+	toSendText = strings.ReplaceAll(toSendText, "\r\n", "<br>")
+	return toSendText
+}
+
+//setMailBody sets the body of m. If useMarkdown is true, the body gets rendered to HTML
+func setMailBody(m *gomail.Message, body string, useMarkdown bool) {
+	if useMarkdown {
+		m.SetBody("text/html", markdownToHTML(body))
+
+		plainbody := body
+		plainbody = strings.ReplaceAll(plainbody, "<br>", "\r\n")
+		m.AddAlternative("text/plain", plainbody)
+	} else {
+		m.SetBody("text/plain", body)
+	}
+}
+
+//smtpTimeout limits the whole SMTP session including the upload of attachments
+const smtpTimeout = 5 * time.Minute
+
+//dialSMTP connects to an smtp server
+var dialSMTP = (&net.Dialer{Timeout: 30 * time.Second}).Dial
+
+//smtpSend sends a serialized email using the given smtp account.
+//Credentials are only sent over unencrypted connections if the server is running on the local machine
+func smtpSend(account *smtpAccount, from string, to []string, msg io.WriterTo) error {
+	addr := net.JoinHostPort(account.host, strconv.Itoa(account.port))
+	tlsConfig := &tls.Config{InsecureSkipVerify: account.ignoreSSL, ServerName: account.host}
+
+	conn, err := dialSMTP("tcp", addr)
+	if err != nil {
+		return err
+	}
+	//a server which stops answering would block the outbox for every room
+	if err = conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	if account.security == securityTLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+
+	c, err := smtp.NewClient(conn, account.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	encrypted := account.security == securityTLS
+	hasStartTLS, _ := c.Extension("STARTTLS")
+	if account.security == securityStartTLS && !hasStartTLS {
+		return errors.New("the server doesn't support STARTTLS")
+	}
+	if hasStartTLS && (account.security == securityStartTLS || account.security == securityOpportunistic) {
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+		encrypted = true
+	}
+
+	if ok, mechs := c.Extension("AUTH"); len(account.username) > 0 {
+		//sending without the configured login would hide a downgrade or a misconfigured server
+		if !ok {
+			return errors.New("the server doesn't offer authentication (AUTH)")
+		}
+		if !encrypted && !isLoopbackHost(account.host) {
+			return errors.New("refusing to send credentials over an unencrypted connection")
+		}
+		var auth smtp.Auth
+		switch {
+		case account.authMethod == authXOAuth2 || account.authMethod == authOAuthBearer:
+			saslClient, err := newSASLClient(account.authMethod, account.username, account.oauthToken, addr)
+			if err != nil {
+				return err
+			}
+			auth = &saslAuth{saslClient}
+		case hasAuthMechanism(mechs, "PLAIN"):
+			auth = smtp.PlainAuth("", account.username, account.password, account.host)
+		case hasAuthMechanism(mechs, "LOGIN"):
+			auth = &loginAuth{account.username, account.password}
+		default:
+			return errors.New("the server supports neither PLAIN nor LOGIN authentication, only " + mechs)
+		}
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	//the server accepted the email, an error on QUIT must not make the outbox send it again
+	c.Quit()
+	return nil
+}
+
+//hasAuthMechanism returns true if mechanism is in the list of authentication mechanisms advertised by an smtp server
+func hasAuthMechanism(mechs, mechanism string) bool {
+	for _, mech := range strings.Fields(mechs) {
+		if strings.EqualFold(mech, mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
+//loginAuth implements the LOGIN authentication for servers not supporting PLAIN
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", []byte{}, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected server challenge: " + string(fromServer))
+}
+
 func parseMailBody(body *string) {
 	*body = strings.ReplaceAll(*body, "<br>", "\r\n")
 	*body = strip.StripTags(html.UnescapeString(*body))
@@ -211,19 +1012,19 @@ func viewMailbox(roomID string, client *mautrix.Client) {
 	imapAccID, _, erro := getRoomAccounts(roomID)
 	if erro != nil {
 		WriteLog(critical, "#50 getRoomAccounts: "+erro.Error())
-		client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #50")
+		sendText(id.RoomID(roomID), "An server-error occured Errorcode: #50")
 		return
 	}
 	if imapAccID != -1 {
 		mailbox, err := getMailbox(roomID)
 		if err != nil {
 			WriteLog(critical, "#51 getMailbox: "+err.Error())
-			client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #51")
+			sendText(id.RoomID(roomID), "An server-error occured Errorcode: #51")
 			return
 		}
-		client.SendText(id.RoomID(roomID), "The current mailbox for this room is: "+mailbox)
+		sendText(id.RoomID(roomID), "The current mailbox for this room is: "+mailbox)
 	} else {
-		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		sendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
 	}
 }
 
@@ -231,19 +1032,23 @@ func viewMailboxes(roomID string, client *mautrix.Client) {
 	imapAccID, _, erro := getRoomAccounts(roomID)
 	if erro != nil {
 		WriteLog(critical, "#48 getRoomAccounts: "+erro.Error())
-		client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #48")
+		sendText(id.RoomID(roomID), "An server-error occured Errorcode: #48")
 		return
 	}
 	if imapAccID != -1 {
-		mailboxes, err := getMailboxes(clients[roomID])
+		mailboxes, err := getRoomMailboxes(roomID)
 		if err != nil {
 			WriteLog(critical, "#47 getMailboxes: "+err.Error())
-			client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #47")
+			sendText(id.RoomID(roomID), "An server-error occured Errorcode: #47")
 			return
 		}
-		client.SendText(id.RoomID(roomID), "Your mailboxes:\r\n"+mailboxes+"\r\nUse !setmailbox <mailbox> to change your mailbox")
+		mboxes := ""
+		for _, mailbox := range mailboxes {
+			mboxes += "-> " + mailbox + "\r\n"
+		}
+		sendText(id.RoomID(roomID), "Your mailboxes:\r\n"+mboxes+"\r\nUse !setmailbox <mailbox> to change your mailbox")
 	} else {
-		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		sendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
 	}
 }
 
@@ -251,7 +1056,7 @@ func viewBlocklist(roomID string, client *mautrix.Client) {
 	imapAccID, _, erro := getRoomAccounts(roomID)
 	if erro != nil {
 		WriteLog(critical, "#48 getRoomAccounts: "+erro.Error())
-		client.SendText(id.RoomID(roomID), "An server-error occured Errorcode: #48")
+		sendText(id.RoomID(roomID), "An server-error occured Errorcode: #48")
 		return
 	}
 	if imapAccID != -1 {
@@ -265,8 +1070,8 @@ func viewBlocklist(roomID string, client *mautrix.Client) {
 		} else {
 			msg = "No addresses blocked!"
 		}
-		client.SendText(id.RoomID(roomID), msg)
+		sendText(id.RoomID(roomID), msg)
 	} else {
-		client.SendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
+		sendText(id.RoomID(roomID), "You have to setup an IMAP account to use this command. Use !setup or !login for more informations")
 	}
 }
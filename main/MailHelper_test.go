@@ -0,0 +1,497 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"gopkg.in/gomail.v2"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	criteria, err := parseSearchQuery(`from:bob SUBJECT:"my mail" since:2022-01-31 before:2022-03-01 unseen hello "two words"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := criteria.Header.Get("From"); got != "bob" {
+		t.Errorf("from = %q, want bob", got)
+	}
+	if got := criteria.Header.Get("Subject"); got != "my mail" {
+		t.Errorf("subject = %q, want \"my mail\"", got)
+	}
+	if want := time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC); !criteria.Since.Equal(want) {
+		t.Errorf("since = %v, want %v", criteria.Since, want)
+	}
+	if want := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC); !criteria.Before.Equal(want) {
+		t.Errorf("before = %v, want %v", criteria.Before, want)
+	}
+	if !reflect.DeepEqual(criteria.WithoutFlags, []string{imap.SeenFlag}) || len(criteria.WithFlags) > 0 {
+		t.Errorf("flags = %v, without %v, want only unseen", criteria.WithFlags, criteria.WithoutFlags)
+	}
+	if want := []string{"hello", "two words"}; !reflect.DeepEqual(criteria.Text, want) {
+		t.Errorf("text = %q, want %q", criteria.Text, want)
+	}
+
+	criteria, err = parseSearchQuery("seen to:alice cc:carol unknown:value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(criteria.WithFlags, []string{imap.SeenFlag}) {
+		t.Errorf("flags = %v, want seen", criteria.WithFlags)
+	}
+	if criteria.Header.Get("To") != "alice" || criteria.Header.Get("Cc") != "carol" {
+		t.Errorf("header = %v, want to alice and cc carol", criteria.Header)
+	}
+	//unknown keys are searched as text
+	if want := []string{"unknown:value"}; !reflect.DeepEqual(criteria.Text, want) {
+		t.Errorf("text = %q, want %q", criteria.Text, want)
+	}
+
+	if _, err = parseSearchQuery("since:31.01.2022"); err == nil {
+		t.Errorf("invalid date accepted")
+	}
+}
+
+func TestParseSecurity(t *testing.T) {
+	tests := []struct {
+		mode, want string
+		wantErr    bool
+	}{
+		{"tls", securityTLS, false},
+		{" SSL ", securityTLS, false},
+		{"StartTLS", securityStartTLS, false},
+		{"plain", securityPlain, false},
+		{"none", securityPlain, false},
+		{"", "", true},
+		{"starttls2", "", true},
+	}
+	for _, test := range tests {
+		got, err := parseSecurity(test.mode)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("parseSecurity(%q) = %q, %v, want %q, error: %v", test.mode, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestGetMails(t *testing.T) {
+	tests := []struct {
+		name                 string
+		stored               bool
+		uidValidity, lastUID uint32
+		newMails, maxCatchUp int
+		wantUIDs             []uint32
+		wantLastUID          uint32
+		wantNotice           string
+	}{
+		//only mails arriving after the first check get bridged
+		{"first check", false, 0, 0, 2, 0, nil, 8, ""},
+		{"nothing new", true, 1, 6, 0, 0, nil, 6, ""},
+		{"new mails", true, 1, 6, 2, 0, []uint32{7, 8}, 6, ""},
+		{"partly bridged", true, 1, 7, 2, 0, []uint32{8}, 7, ""},
+		{"below catch-up limit", true, 1, 6, 3, 3, []uint32{7, 8, 9}, 6, ""},
+		{"catch-up limit", true, 1, 6, 5, 2, []uint32{10, 11}, 6, "3 older messages skipped"},
+		{"uidvalidity changed", true, 5, 2, 1, 0, nil, 7, "The mailbox INBOX was reset by the mailserver. Only new emails will be bridged from now on"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDB(t)
+			_, sentMessages := setupTestMatrix(t, http.NewServeMux())
+			mClient, user := setupTestIMAP(t)
+			for i := 0; i < test.newMails; i++ {
+				addTestMail(t, user, "INBOX", "mail "+string(rune('a'+i)))
+			}
+			account := &imapAccountount{roomID: testRoom.String(), roomPKID: 1, mailbox: "INBOX", username: "username", maxCatchUp: test.maxCatchUp}
+			if test.stored {
+				if err := saveMailboxState(account.roomPKID, account.mailbox, test.uidValidity, test.lastUID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			messages := make(chan *imap.Message, 1)
+			section, uidValidity, lastUID, errCode := getMails(mClient, account, messages)
+			var uids []uint32
+			if section != nil {
+				for msg := range messages {
+					uids = append(uids, msg.Uid)
+				}
+			} else if errCode != 1 {
+				t.Fatalf("errCode = %d, want 1", errCode)
+			}
+			if !reflect.DeepEqual(uids, test.wantUIDs) {
+				t.Errorf("fetched UIDs = %v, want %v", uids, test.wantUIDs)
+			}
+			if uidValidity != 1 || lastUID != test.wantLastUID {
+				t.Errorf("getMails = uidValidity %d, lastUID %d, want 1, %d", uidValidity, lastUID, test.wantLastUID)
+			}
+
+			storedValidity, storedUID, found, err := getMailboxState(account.roomPKID, account.mailbox)
+			if err != nil || !found {
+				t.Fatalf("getMailboxState = %v, %v", found, err)
+			}
+			wantStored := test.lastUID
+			if !test.stored || test.uidValidity != 1 {
+				wantStored = test.wantLastUID
+			}
+			if storedValidity != 1 || storedUID != wantStored {
+				t.Errorf("stored state = %d, %d, want 1, %d", storedValidity, storedUID, wantStored)
+			}
+			var wantMessages []string
+			if len(test.wantNotice) > 0 {
+				wantMessages = []string{test.wantNotice}
+			}
+			if messages := sentMessages(); !reflect.DeepEqual(messages, wantMessages) {
+				t.Errorf("sent messages = %q, want %q", messages, wantMessages)
+			}
+		})
+	}
+}
+
+func TestMarkMailsSeen(t *testing.T) {
+	tests := []struct {
+		name     string
+		eventID  string
+		wantSeen []uint32
+		wantRows []string
+	}{
+		{"first email", "$header7", []uint32{6, 7}, []string{"$header7"}},
+		//all parts of an email and all older emails are marked
+		{"older emails", "$header8", []uint32{6, 7, 8}, []string{"$header7", "$body7", "$header8"}},
+		{"newest email", "$body8", []uint32{6, 7, 8}, []string{"$header7", "$body7", "$header8", "$reset", "$body8"}},
+		{"not an email", "$message", []uint32{6}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDB(t)
+			mClient, user := setupTestIMAP(t)
+			serveTestMailTasks(t, mClient)
+			addTestMail(t, user, "INBOX", "mail a")
+			addTestMail(t, user, "INBOX", "mail b")
+			addTestMail(t, user, "INBOX", "mail c")
+			if _, err := db.Exec("INSERT INTO rooms (roomID) VALUES(?)", testRoom.String()); err != nil {
+				t.Fatal(err)
+			}
+			for _, mail := range []bridgedMail{
+				{eventID: "$header7", uidValidity: 1, uid: 7},
+				{eventID: "$body7", uidValidity: 1, uid: 7},
+				{eventID: "$header8", uidValidity: 1, uid: 8},
+				//bridged before the mailbox was reset, the UID is another email now
+				{eventID: "$reset", uidValidity: 0, uid: 9},
+				{eventID: "$body8", uidValidity: 1, uid: 8},
+				{eventID: "$notice", uidValidity: 1, uid: 0},
+			} {
+				mail.roomPKID = 1
+				mail.mailbox = "INBOX"
+				if err := saveBridgedMail(mail); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			markMailsSeen(testRoom.String(), test.eventID)
+
+			mbox, err := user.GetMailbox("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var seen []uint32
+			for _, msg := range mbox.(*memory.Mailbox).Messages {
+				for _, flag := range msg.Flags {
+					if flag == imap.SeenFlag {
+						seen = append(seen, msg.Uid)
+					}
+				}
+			}
+			if !reflect.DeepEqual(seen, test.wantSeen) {
+				t.Errorf("seen UIDs = %v, want %v", seen, test.wantSeen)
+			}
+
+			rows, err := db.Query("SELECT eventID FROM bridgedMails WHERE seen=1 AND uid!=0 ORDER BY pk_id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var seenRows []string
+			for rows.Next() {
+				var eventID string
+				rows.Scan(&eventID)
+				seenRows = append(seenRows, eventID)
+			}
+			if !reflect.DeepEqual(seenRows, test.wantRows) {
+				t.Errorf("rows marked as seen = %q, want %q", seenRows, test.wantRows)
+			}
+		})
+	}
+}
+
+func TestDeleteRedactedMail(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     interface{}
+		wantInbox  []uint32
+		wantTrash  int
+		wantUID    uint32
+		wantNotice string
+	}{
+		{"default", "", []uint32{6, 7, 8}, 0, 7, ""},
+		{"not set", nil, []uint32{6, 7, 8}, 0, 7, ""},
+		{"off", redactActionOff, []uint32{6, 7, 8}, 0, 7, ""},
+		{"trash", redactActionTrash, []uint32{6, 8}, 1, 0, ""},
+		//without UIDPLUS the other email flagged as deleted would be expunged as well
+		{"delete without UIDPLUS", redactActionDelete, []uint32{6, 7, 8}, 0, 7, "Couldn't delete the email \"mail a\": " + errNoUIDPlus.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDB(t)
+			_, sentMessages := setupTestMatrix(t, http.NewServeMux())
+			mClient, user := setupTestIMAP(t)
+			serveTestMailTasks(t, mClient)
+			addTestMail(t, user, "INBOX", "mail a")
+			addTestMail(t, user, "INBOX", "mail b")
+			if err := user.CreateMailbox("Trash"); err != nil {
+				t.Fatal(err)
+			}
+			mbox, err := user.GetMailbox("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			//another client flagged the second email as deleted without expunging it
+			seqSet := new(imap.SeqSet)
+			seqSet.AddNum(8)
+			if err = mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.action == "" {
+				_, err = db.Exec("INSERT INTO rooms (roomID) VALUES(?)", testRoom.String())
+			} else {
+				_, err = db.Exec("INSERT INTO rooms (roomID, redactAction) VALUES(?,?)", testRoom.String(), test.action)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			mail := bridgedMail{roomPKID: 1, eventID: "$mail", subject: "mail a", mailbox: "INBOX", uidValidity: 1, uid: 7}
+			if err = saveBridgedMail(mail); err != nil {
+				t.Fatal(err)
+			}
+
+			deleteRedactedMail(testRoom.String(), &mail)
+
+			var inbox []uint32
+			for _, msg := range mbox.(*memory.Mailbox).Messages {
+				inbox = append(inbox, msg.Uid)
+				for _, flag := range msg.Flags {
+					if flag == imap.DeletedFlag && msg.Uid != 8 {
+						t.Errorf("email %d flagged as deleted", msg.Uid)
+					}
+				}
+			}
+			if !reflect.DeepEqual(inbox, test.wantInbox) {
+				t.Errorf("INBOX UIDs = %v, want %v", inbox, test.wantInbox)
+			}
+			trash, err := user.GetMailbox("Trash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(trash.(*memory.Mailbox).Messages); got != test.wantTrash {
+				t.Errorf("%d emails in the trash, want %d", got, test.wantTrash)
+			}
+
+			stored, err := getBridgedMail(testRoom.String(), "$mail")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.uid != test.wantUID {
+				t.Errorf("bridged UID = %d, want %d", stored.uid, test.wantUID)
+			}
+			var wantMessages []string
+			if len(test.wantNotice) > 0 {
+				wantMessages = []string{test.wantNotice}
+			}
+			if messages := sentMessages(); !reflect.DeepEqual(messages, wantMessages) {
+				t.Errorf("sent messages = %q, want %q", messages, wantMessages)
+			}
+		})
+	}
+}
+
+func TestMoveMail(t *testing.T) {
+	tests := []struct {
+		name        string
+		mailboxes   []string
+		wantArchive string
+		wantInbox   []uint32
+		wantUID     uint32
+	}{
+		{"archive", []string{"Archive"}, "Archive", []uint32{6, 8}, 0},
+		{"other archive name", []string{"Sent", "Archives"}, "Archives", []uint32{6, 8}, 0},
+		{"no archive", []string{"Sent"}, "", []uint32{6, 7, 8}, 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDB(t)
+			mClient, user := setupTestIMAP(t)
+			serveTestMailTasks(t, mClient)
+			addTestMail(t, user, "INBOX", "mail a")
+			addTestMail(t, user, "INBOX", "mail b")
+			for _, mailbox := range test.mailboxes {
+				if err := user.CreateMailbox(mailbox); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.Exec("INSERT INTO rooms (roomID) VALUES(?)", testRoom.String()); err != nil {
+				t.Fatal(err)
+			}
+			mail := bridgedMail{roomPKID: 1, eventID: "$header", mailbox: "INBOX", uidValidity: 1, uid: 7}
+			for _, eventID := range []string{"$header", "$body"} {
+				mail.eventID = eventID
+				if err := saveBridgedMail(mail); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			archive, err := getArchiveMailbox(testRoom.String())
+			if archive != test.wantArchive || (err != nil) != (len(test.wantArchive) == 0) {
+				t.Fatalf("getArchiveMailbox = %q, %v, want %q", archive, err, test.wantArchive)
+			}
+			if len(archive) > 0 {
+				if err = moveMail(testRoom.String(), &mail, archive); err != nil {
+					t.Fatal(err)
+				}
+				moved, err := user.GetMailbox(archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := len(moved.(*memory.Mailbox).Messages); got != 1 {
+					t.Errorf("%d emails in %s, want 1", got, archive)
+				}
+			}
+
+			mbox, err := user.GetMailbox("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var inbox []uint32
+			for _, msg := range mbox.(*memory.Mailbox).Messages {
+				inbox = append(inbox, msg.Uid)
+			}
+			if !reflect.DeepEqual(inbox, test.wantInbox) {
+				t.Errorf("INBOX UIDs = %v, want %v", inbox, test.wantInbox)
+			}
+			//all events of the email are unlinked from the moved message
+			for _, eventID := range []string{"$header", "$body"} {
+				stored, err := getBridgedMail(testRoom.String(), eventID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.uid != test.wantUID {
+					t.Errorf("UID of %s = %d, want %d", eventID, stored.uid, test.wantUID)
+				}
+			}
+		})
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	tests := []struct {
+		name         string
+		host         string
+		security     string
+		username     string
+		extensions   []string
+		wantErr      string
+		wantCommands []string
+	}{
+		{"plain to localhost", "127.0.0.1", securityPlain, "me", []string{"AUTH PLAIN LOGIN"}, "",
+			[]string{"EHLO localhost", "AUTH PLAIN", "MAIL FROM:<me@example.org>", "RCPT TO:<you@example.org>", "DATA", "QUIT"}},
+		{"plain to a remote host", "mail.example.org", securityPlain, "me", []string{"AUTH PLAIN LOGIN"}, "refusing to send credentials over an unencrypted connection",
+			[]string{"EHLO localhost"}},
+		{"plain without login", "mail.example.org", securityPlain, "", nil, "",
+			[]string{"EHLO localhost", "MAIL FROM:<me@example.org>", "RCPT TO:<you@example.org>", "DATA", "QUIT"}},
+		{"starttls", "mail.example.org", securityStartTLS, "me", []string{"STARTTLS", "AUTH PLAIN"}, "",
+			[]string{"EHLO localhost", "STARTTLS", "EHLO localhost", "AUTH PLAIN", "MAIL FROM:<me@example.org>", "RCPT TO:<you@example.org>", "DATA", "QUIT"}},
+		{"starttls not offered", "mail.example.org", securityStartTLS, "me", []string{"AUTH PLAIN"}, "the server doesn't support STARTTLS",
+			[]string{"EHLO localhost"}},
+		{"opportunistic starttls", "mail.example.org", securityOpportunistic, "me", []string{"STARTTLS", "AUTH PLAIN"}, "",
+			[]string{"EHLO localhost", "STARTTLS", "EHLO localhost", "AUTH PLAIN", "MAIL FROM:<me@example.org>", "RCPT TO:<you@example.org>", "DATA", "QUIT"}},
+		{"opportunistic without starttls to localhost", "localhost", securityOpportunistic, "me", []string{"AUTH PLAIN"}, "",
+			[]string{"EHLO localhost", "AUTH PLAIN", "MAIL FROM:<me@example.org>", "RCPT TO:<you@example.org>", "DATA", "QUIT"}},
+		{"opportunistic without starttls to a remote host", "mail.example.org", securityOpportunistic, "me", []string{"AUTH PLAIN"}, "refusing to send credentials over an unencrypted connection",
+			[]string{"EHLO localhost"}},
+		{"tls", "mail.example.org", securityTLS, "me", []string{"AUTH PLAIN"}, "",
+			[]string{"EHLO localhost", "AUTH PLAIN", "MAIL FROM:<me@example.org>", "RCPT TO:<you@example.org>", "DATA", "QUIT"}},
+		{"login only", "mail.example.org", securityStartTLS, "me", []string{"STARTTLS", "AUTH LOGIN"}, "",
+			[]string{"EHLO localhost", "STARTTLS", "EHLO localhost", "AUTH LOGIN", "MAIL FROM:<me@example.org>", "RCPT TO:<you@example.org>", "DATA", "QUIT"}},
+		{"no supported mechanism", "mail.example.org", securityStartTLS, "me", []string{"STARTTLS", "AUTH CRAM-MD5 XLOGIN"}, "the server supports neither PLAIN nor LOGIN authentication, only CRAM-MD5 XLOGIN",
+			[]string{"EHLO localhost", "STARTTLS", "EHLO localhost"}},
+		{"no authentication offered", "mail.example.org", securityStartTLS, "me", []string{"STARTTLS"}, "the server doesn't offer authentication (AUTH)",
+			[]string{"EHLO localhost", "STARTTLS", "EHLO localhost"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			smtpServer := setupTestSMTP(t, test.extensions...)
+			smtpServer.implicitTLS = test.security == securityTLS
+			account := &smtpAccount{host: test.host, port: 25, username: test.username, password: "secret", ignoreSSL: true, security: test.security}
+			m := gomail.NewMessage()
+			m.SetHeader("From", "me@example.org")
+			m.SetHeader("To", "you@example.org")
+			m.SetHeader("Subject", "Hello")
+			m.SetBody("text/plain", "Hello you")
+
+			err := smtpSend(account, "me@example.org", []string{"you@example.org"}, m)
+			if (err == nil && len(test.wantErr) > 0) || (err != nil && err.Error() != test.wantErr) {
+				t.Errorf("smtpSend = %v, want %q", err, test.wantErr)
+			}
+			commands, mails := smtpServer.received()
+			//the client quits or closes the connection after an error
+			if len(test.wantErr) > 0 && len(commands) > 0 && commands[len(commands)-1] == "QUIT" {
+				commands = commands[:len(commands)-1]
+			}
+			if !reflect.DeepEqual(commands, test.wantCommands) {
+				t.Errorf("commands = %q, want %q", commands, test.wantCommands)
+			}
+			if len(test.wantErr) == 0 && (len(mails) != 1 || !strings.Contains(mails[0], "Hello you")) {
+				t.Errorf("mails = %q, want the sent mail", mails)
+			} else if len(test.wantErr) > 0 && len(mails) > 0 {
+				t.Errorf("mails = %q, want none", mails)
+			}
+		})
+	}
+}
+
+func TestReplaceInlineImages(t *testing.T) {
+	setupTestDB(t)
+	mux := http.NewServeMux()
+	setupTestMatrix(t, mux)
+	var uploads []string
+	mux.HandleFunc("/_matrix/media/", func(w http.ResponseWriter, r *http.Request) {
+		filename := r.URL.Query().Get("filename")
+		uploads = append(uploads, filename)
+		if filename == "broken.png" {
+			writeJSON(w, http.StatusInternalServerError, `{"errcode":"M_UNKNOWN"}`)
+			return
+		}
+		writeJSON(w, http.StatusOK, `{"content_uri":"mxc://example.org/`+strings.TrimSuffix(filename, ".png")+`"}`)
+	})
+
+	inlineParts := map[string]mailAttachment{
+		"logo@example.org":    {filename: "logo.png", mimeType: "image/png", data: []byte("logo")},
+		"image 1@example.org": {filename: "image1.png", mimeType: "image/png", data: []byte("image")},
+		"broken@example.org":  {filename: "broken.png", mimeType: "image/png", data: []byte("broken")},
+		"unused@example.org":  {filename: "unused.png", mimeType: "image/png", data: []byte("unused")},
+	}
+	body := `<img src="cid:logo@example.org"><img src="cid:logo@example.org"><img src="cid:image%201@example.org"><img src="cid:broken@example.org">`
+	want := `<img src="mxc://example.org/logo"><img src="mxc://example.org/logo"><img src="mxc://example.org/image1"><img src="cid:broken@example.org">`
+	if got := replaceInlineImages(body, inlineParts); got != want {
+		t.Errorf("replaceInlineImages = %q, want %q", got, want)
+	}
+
+	//every referenced part is uploaded once, unreferenced parts aren't uploaded at all
+	sort.Strings(uploads)
+	if want := []string{"broken.png", "image1.png", "logo.png"}; !reflect.DeepEqual(uploads, want) {
+		t.Errorf("uploads = %q, want %q", uploads, want)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -9,21 +10,23 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
-	"github.com/gomarkdown/markdown"
-
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/viper"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
 )
 
-const version = 7
+const version = 20
+
+const relThread event.RelationType = "m.thread"
 
 var db *sql.DB
 var matrixClient *mautrix.Client
@@ -60,6 +63,14 @@ func initCfg() bool {
 		viper.SetDefault("matrixuserpassword", "AverySecretPassword21!")
 		viper.SetDefault("matrixuserid", "@m:matrix.org")
 		viper.SetDefault("defaultmailCheckInterval", 30)
+		viper.SetDefault("defaultMaxCatchUp", 50)
+		viper.SetDefault("defaultMaxAttachmentSize", 10)
+		viper.SetDefault("oauthProviders", defaultOAuthProviders)
+		viper.SetDefault("masterKeyFile", "")
+		viper.SetDefault("setupFormListen", "127.0.0.1:8443")
+		viper.SetDefault("setupFormURL", "https://localhost:8443")
+		viper.SetDefault("setupFormCert", "")
+		viper.SetDefault("setupFormKey", "")
 		viper.SetDefault("markdownEnabledByDefault", true)
 		viper.SetDefault("htmlDefault", false)
 		viper.SetDefault("allowed_servers", [1]string{"YourMatrixServerDomain.com"})
@@ -73,6 +84,44 @@ func initCfg() bool {
 		viper.WriteConfigAs(dirPrefix + "cfg.json")
 	}
 
+	if !viper.IsSet("defaultMaxCatchUp") {
+		viper.SetDefault("defaultMaxCatchUp", 50)
+		viper.WriteConfigAs(dirPrefix + "cfg.json")
+	}
+
+	if !viper.IsSet("defaultMaxAttachmentSize") {
+		viper.SetDefault("defaultMaxAttachmentSize", 10)
+		viper.WriteConfigAs(dirPrefix + "cfg.json")
+	}
+
+	if !viper.IsSet("oauthProviders") {
+		viper.SetDefault("oauthProviders", defaultOAuthProviders)
+		viper.WriteConfigAs(dirPrefix + "cfg.json")
+	}
+
+	if !viper.IsSet("masterKeyFile") {
+		viper.SetDefault("masterKeyFile", "")
+		viper.WriteConfigAs(dirPrefix + "cfg.json")
+	}
+
+	if !viper.IsSet("appservice") {
+		viper.SetDefault("appservice.enabled", false)
+		viper.SetDefault("appservice.registration", dirPrefix+"registration.yaml")
+		viper.SetDefault("appservice.url", "http://localhost:29320")
+		viper.SetDefault("appservice.hostname", "127.0.0.1")
+		viper.SetDefault("appservice.port", 29320)
+		viper.SetDefault("appservice.userprefix", "email_")
+		viper.WriteConfigAs(dirPrefix + "cfg.json")
+	}
+
+	if !viper.IsSet("setupFormListen") {
+		viper.SetDefault("setupFormListen", "127.0.0.1:8443")
+		viper.SetDefault("setupFormURL", "https://localhost:8443")
+		viper.SetDefault("setupFormCert", "")
+		viper.SetDefault("setupFormKey", "")
+		viper.WriteConfigAs(dirPrefix + "cfg.json")
+	}
+
 	allowedHosts := viper.GetStringSlice("allowed_servers")
 	if len(allowedHosts) == 0 {
 		allowedHosts = make([]string, 1)
@@ -90,19 +139,36 @@ func loginMatrix() {
 	if err != nil {
 		panic(err)
 	}
-	_, err = client.Login(&mautrix.ReqLogin{
-		Type:             "m.login.password",
-		Identifier:       mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: viper.GetString("matrixuserid")},
-		Password:         viper.GetString("matrixuserpassword"),
-		StoreCredentials: true,
-	})
+	//the device id is reused, otherwise every restart would create a new device with new encryption keys
+	store = NewFileStore(dirPrefix+"store.json", id.UserID(viper.GetString("matrixuserid")))
+	loginRequest := &mautrix.ReqLogin{
+		Type:                     "m.login.password",
+		Identifier:               mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: viper.GetString("matrixuserid")},
+		Password:                 viper.GetString("matrixuserpassword"),
+		DeviceID:                 store.DeviceID,
+		InitialDeviceDisplayName: "Matrix-EmailBridge",
+		StoreCredentials:         true,
+	}
+	if appService != nil {
+		//the bot is the sender of the appservice and logs in with the as_token
+		client.AccessToken = appService.Registration.AppToken
+		loginRequest.Type = mautrix.AuthTypeAppservice
+		loginRequest.Password = ""
+	}
+	resp, err := client.Login(loginRequest)
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("Login successful")
-	store = NewFileStore(dirPrefix+"store.json", client.UserID)
+	store.userID = client.UserID
+	store.DeviceID = resp.DeviceID
+	store.Save()
 	client.Store = store
 	matrixClient = client
+	if err = initCrypto(); err != nil {
+		WriteLog(critical, "#120 initializing encryption: "+err.Error())
+		panic(err)
+	}
 	go startMatrixSync()
 }
 
@@ -128,7 +194,10 @@ func contains(a []string, x string) bool {
 
 func logOut(client *mautrix.Client, roomID string, leave bool) error {
 	stopMailChecker(roomID)
+	//portal rooms can't be used without their bridged room
+	leavePortals(roomID)
 	deleteRoomAndEmailByRoomID(roomID)
+	deletePortal(roomID)
 	if leave {
 		_, err := client.LeaveRoom(id.RoomID(roomID))
 		if err != nil {
@@ -156,7 +225,7 @@ func startMatrixSync() {
 					listcontains := contains(viper.GetStringSlice("allowed_servers"), host)
 					if listcontains {
 						client.JoinRoomByID(evt.RoomID)
-						client.SendText(evt.RoomID, "Hey you have invited me to a new room. Enter !login to bridge this room to a Mail account")
+						sendText(evt.RoomID, "Hey you have invited me to a new room. Enter !login to bridge this room to a Mail account")
 					} else {
 						client.LeaveRoom(evt.RoomID)
 						WriteLog(info, string("Got invalid invite from "+evt.Sender+" reason: senders server not whitelisted! Adjust your config if you want to allow this host using me"))
@@ -173,26 +242,49 @@ func startMatrixSync() {
 		}
 	})
 
-	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
-		if evt.Sender == matrixClient.UserID {
+	syncer.OnEventType(event.EventMessage, handleMessageEvent)
+	syncer.OnEventType(event.EventEncrypted, handleEncryptedEvent)
+
+	syncer.OnEventType(event.StateEncryption, func(source mautrix.EventSource, evt *event.Event) {
+		store.SetEncryptionEvent(evt)
+	})
+
+	syncer.OnEventType(event.EventRedaction, func(source mautrix.EventSource, evt *event.Event) {
+		if evt.Sender == matrixClient.UserID || isPuppet(evt.Sender) {
 			return
 		}
 		currentMembership, timestamp := store.GetMembershipState(evt.RoomID)
 		if currentMembership == event.MembershipLeave || timestamp > evt.Timestamp {
 			return
 		}
-		message := evt.Content.AsMessage().Body
-		roomID := evt.RoomID
+		if removeDraftLine(evt.RoomID, evt.Redacts) {
+			return
+		}
+		roomID := controlRoomID(evt.RoomID.String())
+		mail, err := getBridgedMail(roomID, evt.Redacts.String())
+		if err != nil {
+			WriteLog(logError, "#93 getBridgedMail: "+err.Error())
+			return
+		}
+		if mail != nil && mail.uid != 0 {
+			go deleteRedactedMail(roomID, mail)
+		}
+	})
 
-		if is, err := isUserWritingEmail(string(roomID)); is && err == nil {
-			writingEmail(evt, message)
-		} else if err != nil {
-			WriteLog(critical, "#41 deleteWritingTemp: "+err.Error())
-			matrixClient.SendText(roomID, "An server-error occured Errorcode: #41")
+	syncer.OnEventType(event.EphemeralEventReceipt, func(source mautrix.EventSource, evt *event.Event) {
+		roomID := controlRoomID(evt.RoomID.String())
+		enabled, err := isReadSyncEnabled(roomID)
+		if err != nil || !enabled {
 			return
-		} else {
-			//commands only available in room not bridged to email
-			runCommand(message, evt)
+		}
+		for eventID, receipts := range *evt.Content.AsReceipt() {
+			for userID := range receipts.Read {
+				if userID == matrixClient.UserID {
+					continue
+				}
+				go markMailsSeen(roomID, eventID.String())
+				break
+			}
 		}
 	})
 
@@ -203,8 +295,70 @@ func startMatrixSync() {
 	}
 }
 
+//handleMessageEvent handles plain and decrypted messages
+func handleMessageEvent(source mautrix.EventSource, evt *event.Event) {
+	if evt.Sender == matrixClient.UserID || isPuppet(evt.Sender) {
+		return
+	}
+	currentMembership, timestamp := store.GetMembershipState(evt.RoomID)
+	if currentMembership == event.MembershipLeave || timestamp > evt.Timestamp {
+		return
+	}
+	message := evt.Content.AsMessage().Body
+	roomID := evt.RoomID
+	replyTo := getInReplyTo(evt)
+	if len(replyTo) > 0 {
+		message = event.TrimReplyFallbackText(message)
+	}
+
+	if edited := getReplacedEvent(evt); len(edited) > 0 {
+		//only edits of lines of an email in writing are handled
+		if !editDraftLine(evt, edited) {
+			if is, err := isUserWritingEmail(roomID.String()); is && err == nil {
+				sendText(roomID, "Only messages added as line to the email can be edited")
+			}
+		}
+		return
+	}
+
+	portal, err := getPortalByRoomID(roomID.String())
+	if err != nil {
+		WriteLog(logError, "#152 getPortalByRoomID: "+err.Error())
+	}
+	accountRoom := roomID.String()
+	if portal != nil {
+		accountRoom = portal.controlRoomID
+	}
+
+	if is, err := isUserWritingEmail(string(roomID)); is && err == nil {
+		writingEmail(evt, message)
+	} else if err != nil {
+		WriteLog(critical, "#41 deleteWritingTemp: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #41")
+		return
+	} else if len(replyTo) > 0 && !strings.HasPrefix(message, "!") {
+		mail, err := getBridgedMail(accountRoom, replyTo.String())
+		if err != nil {
+			WriteLog(critical, "#81 getBridgedMail: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #81")
+			return
+		}
+		if mail != nil {
+			replyToMail(evt, message, mail)
+		} else if portal != nil {
+			replyInPortal(evt, message, portal)
+		}
+	} else if portal != nil && !strings.HasPrefix(message, "!") {
+		//everything written in a portal room goes to its correspondent
+		replyInPortal(evt, message, portal)
+	} else {
+		//commands only available in room not bridged to email
+		runCommand(message, evt)
+	}
+}
+
 func viewViewHelp(roomID string) {
-	matrixClient.SendText(id.RoomID(roomID), "Available options:\n\nmb/mailbox\t-\tViews the current used mailbox\nmbs/mailboxes\t-\tView the available mailboxes\nbl/blocklist\t-\tViews the list of blocked addresses")
+	sendText(id.RoomID(roomID), "Available options:\n\nmb/mailbox\t-\tViews the current used mailbox\nmbs/mailboxes\t-\tView the available mailboxes\nbl/blocklist\t-\tViews the list of blocked addresses")
 }
 
 func deleteTempFile(name string) {
@@ -283,16 +437,37 @@ func main() {
 		}
 		WriteLog(success, "create tables")
 		handleDBVersion()
+		if err := initMasterKey(); err != nil {
+			WriteLog(critical, "#111 loading master key: "+err.Error())
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		if err := encryptStoredCredentials(); err != nil {
+			WriteLog(critical, "#112 encrypting stored passwords: "+err.Error())
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
 	} else {
 		WriteLog(critical, "#08 creating tables: "+er.Error())
 		panic(er)
 	}
 
-	deleteAllWritingTemps()
+	if viper.GetBool("appservice.enabled") {
+		exit, err := initAppservice()
+		if err != nil {
+			WriteLog(critical, "#123 starting appservice: "+err.Error())
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		if exit {
+			return
+		}
+	}
 
 	loginMatrix()
 
 	startMailSchedeuler()
+	startOutbox()
 
 	for {
 		time.Sleep(1 * time.Second)
@@ -300,17 +475,24 @@ func main() {
 }
 
 func stopMailChecker(roomID string) {
-	_, ok := listenerMap[roomID]
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	quit, ok := listenerMap[roomID]
 	if ok {
-		close(listenerMap[roomID])
-		//delete(listenerMap, evt.RoomID)
+		close(quit)
+		delete(listenerMap, roomID)
+		delete(clients, roomID)
+		delete(mailTasks, roomID)
 	}
 }
 
-var listenerMap map[string]chan bool
-var clients map[string]*client.Client
-var imapErrors map[string]*imapError
-var checksPerAccount map[string]int
+//the listener maps are used by the mail listeners and the command handlers, so every access has to hold listenerMutex
+var listenerMap = make(map[string]chan bool)
+var clients = make(map[string]*client.Client)
+var mailTasks = make(map[string]chan *mailTask)
+var imapErrors = make(map[string]*imapError)
+var checksPerAccount = make(map[string]int)
+var listenerMutex sync.Mutex
 
 const maxRoomChecks = 15
 
@@ -321,28 +503,38 @@ type imapError struct {
 }
 
 func getChecksForAccount(roomID string) int {
-	checks, ok := checksPerAccount[roomID]
-	if ok {
-		return checks
-	}
-	checksPerAccount[roomID] = 0
-	return 0
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	return checksPerAccount[roomID]
 }
 
-func hasError(roomID string) (has bool, count int) {
-	_, ok := imapErrors[roomID]
-	if ok {
-		return true, imapErrors[roomID].retryCount
+func addCheckForAccount(roomID string) {
+	listenerMutex.Lock()
+	checksPerAccount[roomID]++
+	listenerMutex.Unlock()
+}
+
+//countMailError counts an error of the account and returns true if it has to reconnect
+func countMailError(account *imapAccountount) bool {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	imapErr, ok := imapErrors[account.roomID]
+	if !ok {
+		return false
+	}
+	if imapErr.loginErrCount > 15 {
+		WriteLog(logError, "Youve got too much errors for the emailaccount: "+account.username)
+	}
+	if imapErr.retryCount < maxErrUntilReconnect {
+		imapErr.retryCount++
+		return false
 	}
-	return false, -1
+	imapErr.retryCount = 0
+	imapErr.loginErrCount++
+	return true
 }
 
 func startMailSchedeuler() {
-	listenerMap = make(map[string]chan bool)
-	clients = make(map[string]*client.Client)
-	imapErrors = make(map[string]*imapError)
-	checksPerAccount = make(map[string]int)
-
 	accounts, err := getimapAccounts()
 	if err != nil {
 		WriteLog(critical, "#09 reading accounts: "+err.Error())
@@ -360,7 +552,7 @@ func startMailListener(account imapAccountount) {
 	var mClient *client.Client
 	var err error
 	for !connectSuccess {
-		mClient, err = loginMail(account.host, account.username, account.password, account.ignoreSSL)
+		mClient, err = loginMail(&account)
 		if err == nil {
 			connectSuccess = true
 			continue
@@ -370,29 +562,143 @@ func startMailListener(account imapAccountount) {
 		}
 	}
 
+	tasks := make(chan *mailTask)
+	listenerMutex.Lock()
 	listenerMap[account.roomID] = quit
 	clients[account.roomID] = mClient
-	go func() {
+	mailTasks[account.roomID] = tasks
+	listenerMutex.Unlock()
+
+	supportsIdle, err := mClient.Support("IDLE")
+	if err != nil {
+		WriteLog(info, "couldn't read capabilities of "+account.username+": "+err.Error())
+	}
+	if supportsIdle {
+		go idleMailListener(mClient, account, quit, tasks)
+	} else {
+		go pollMailListener(mClient, account, quit, tasks)
+	}
+}
+
+//mailTask is a function which has to be run on the imap connection of a room
+type mailTask struct {
+	run  func(*client.Client) error
+	done chan error
+}
+
+//runOnMailClient runs fn on the imap connection of the given room.
+//The listener of the room pauses IDLE while fn is running
+func runOnMailClient(roomID string, fn func(*client.Client) error) error {
+	listenerMutex.Lock()
+	tasks, ok := mailTasks[roomID]
+	listenerMutex.Unlock()
+	if !ok {
+		return errors.New("no imap connection for this room")
+	}
+	task := &mailTask{fn, make(chan error, 1)}
+	select {
+	case tasks <- task:
+		return <-task.done
+	case <-time.After(2 * time.Minute):
+		return errors.New("imap connection is busy")
+	}
+}
+
+func pollMailListener(mClient *client.Client, account imapAccountount, quit chan bool, tasks chan *mailTask) {
+	for {
+		if getChecksForAccount(account.roomID) >= maxRoomChecks {
+			reconnect(account)
+			return
+		}
+		fetchNewMails(mClient, &account)
+		addCheckForAccount(account.roomID)
+
+		wait := time.After((time.Duration)(account.mailCheckInterval) * time.Second)
+	waitLoop:
 		for {
 			select {
 			case <-quit:
 				return
-			default:
-				if getChecksForAccount(account.roomID) >= maxRoomChecks {
-					reconnect(account)
-					return
+			case task := <-tasks:
+				task.done <- task.run(mClient)
+			case <-wait:
+				break waitLoop
+			}
+		}
+	}
+}
+
+func idleMailListener(mClient *client.Client, account imapAccountount, quit chan bool, tasks chan *mailTask) {
+	newMail := make(chan bool, 1)
+	updates := make(chan client.Update, 10)
+	mClient.Updates = updates
+	go func() {
+		for {
+			select {
+			case update := <-updates:
+				if _, ok := update.(*client.MailboxUpdate); ok {
+					select {
+					case newMail <- true:
+					default:
+					}
 				}
-				fetchNewMails(mClient, &account)
-				checksPerAccount[account.roomID]++
-				time.Sleep((time.Duration)(account.mailCheckInterval) * time.Second)
+			case <-mClient.LoggedOut():
+				return
 			}
 		}
 	}()
+
+	for {
+		fetchNewMails(mClient, &account)
+
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- mClient.Idle(stop, nil)
+		}()
+
+		var err error
+	idleLoop:
+		for {
+			select {
+			case <-quit:
+				close(stop)
+				<-done
+				mClient.Logout()
+				return
+			case task := <-tasks:
+				close(stop)
+				if err = <-done; err != nil {
+					task.done <- err
+					break idleLoop
+				}
+				//tasks may select other mailboxes, so the mailbox gets selected again before idling
+				task.done <- task.run(mClient)
+				break idleLoop
+			case <-newMail:
+				close(stop)
+				err = <-done
+				break idleLoop
+			case err = <-done:
+				if err == nil {
+					err = errors.New("idle stopped unexpectedly")
+				}
+				break idleLoop
+			}
+		}
+		if err != nil {
+			WriteLog(info, "idle of account "+account.username+" failed: "+err.Error())
+			reconnect(account)
+			return
+		}
+	}
 }
 
 func reconnect(account imapAccountount) {
 	WriteLog(info, "reconnecting account "+account.username)
+	listenerMutex.Lock()
 	checksPerAccount[account.roomID] = 0
+	listenerMutex.Unlock()
 	stopMailChecker(account.roomID)
 	nacc := account
 	go startMailListener(nacc)
@@ -400,24 +706,12 @@ func reconnect(account imapAccountount) {
 
 func fetchNewMails(mClient *client.Client, account *imapAccountount) {
 	messages := make(chan *imap.Message, 1)
-	section, errCode := getMails(mClient, account.mailbox, messages)
+	section, uidValidity, lastUID, errCode := getMails(mClient, account, messages)
 
 	if section == nil {
-		if errCode == 0 {
-			haserr, errCount := hasError(account.roomID)
-			if haserr {
-				if imapErrors[account.roomID].loginErrCount > 15 {
-					WriteLog(logError, "Youve got too much errors for the emailaccount: "+account.username)
-				}
-				if errCount < maxErrUntilReconnect {
-					imapErrors[account.roomID].retryCount++
-				} else {
-					imapErrors[account.roomID].retryCount = 0
-					imapErrors[account.roomID].loginErrCount++
-					reconnect(*account)
-					return
-				}
-			}
+		if errCode == 0 && countMailError(account) {
+			reconnect(*account)
+			return
 		}
 		if account.silence {
 			account.silence = false
@@ -426,14 +720,15 @@ func fetchNewMails(mClient *client.Client, account *imapAccountount) {
 	}
 
 	for msg := range messages {
-		mailID := msg.Envelope.Subject + strconv.Itoa(int(msg.InternalDate.Unix()))
-		if has, err := dbContainsMail(mailID, account.roomPKID); !has && err == nil {
-			go insertEmail(mailID, account.roomPKID)
-			if !account.silence {
-				handleMail(msg, section, *account)
-			}
-		} else if err != nil {
-			WriteLog(logError, "#11 dbContains mail: "+err.Error())
+		if msg.Uid <= lastUID {
+			continue
+		}
+		if !account.silence {
+			handleMail(msg, section, *account, uidValidity)
+		}
+		lastUID = msg.Uid
+		if err := saveMailboxState(account.roomPKID, account.mailbox, uidValidity, lastUID); err != nil {
+			WriteLog(logError, "#11 saveMailboxState: "+err.Error())
 			fmt.Println(err.Error())
 		}
 	}
@@ -442,7 +737,17 @@ func fetchNewMails(mClient *client.Client, account *imapAccountount) {
 	}
 }
 
-func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapAccountount) {
+func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapAccountount, uidValidity uint32) {
+	postMail(mail, section, account, uidValidity, "")
+}
+
+//showMail posts an email into the given room, without moving it into a portal or an existing thread
+func showMail(mail *imap.Message, section *imap.BodySectionName, account imapAccountount, uidValidity uint32, roomID id.RoomID) {
+	postMail(mail, section, account, uidValidity, roomID)
+}
+
+//postMail bridges an email into showIn or, if it's empty, into the room of the account, its portal and thread
+func postMail(mail *imap.Message, section *imap.BodySectionName, account imapAccountount, uidValidity uint32, showIn id.RoomID) {
 	content := getMailContent(mail, section, account.roomID)
 	if content == nil {
 		return
@@ -455,7 +760,6 @@ func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapA
 		}
 	}
 	from := html.EscapeString(content.from)
-	fmt.Println("attachments: " + content.attachment)
 	headerContent := &event.MessageEventContent{
 		Format:        event.FormatHTML,
 		Body:          "\r\n────────────────────────────────────\r\n## You've got a new Email from " + from + "\r\n" + "Subject: " + content.subject + "\r\n" + "────────────────────────────────────",
@@ -463,17 +767,129 @@ func handleMail(mail *imap.Message, section *imap.BodySectionName, account imapA
 		MsgType:       event.MsgText,
 	}
 
-	matrixClient.SendMessageEvent(id.RoomID(account.roomID), event.EventMessage, &headerContent)
+	normalizedSubject := normalizeSubject(content.subject)
+	messageIDs := append(content.inReplyTo, reverse(content.references)...)
+
+	//emails go into the portal of their correspondent or conversation if portals are enabled
+	roomID := id.RoomID(account.roomID)
+	portalPK := -1
+	if len(showIn) > 0 {
+		roomID = showIn
+		if portal, err := getPortalByRoomID(showIn.String()); err == nil && portal != nil {
+			portalPK = portal.pk
+		}
+	} else if portal := portalForMail(account, content, messageIDs, normalizedSubject); portal != nil {
+		roomID = id.RoomID(portal.roomID)
+		portalPK = portal.pk
+	}
+
+	//in appservice mode the email gets posted by the puppet of the sender
+	var puppet *appservice.IntentAPI
+	if len(content.sendermails) > 0 {
+		puppet = getPuppet(roomID, content.sendermails[0], content.senderName)
+	}
+	if puppet != nil {
+		headerContent.Body = "Subject: " + content.subject
+		headerContent.FormattedBody = "<b>" + html.EscapeString(content.subject) + "</b>"
+	}
+
+	var threadRoot id.EventID
+	if len(showIn) == 0 {
+		root, err := findThreadRoot(account.roomPKID, portalPK, messageIDs, normalizedSubject)
+		if err != nil {
+			WriteLog(logError, "#86 findThreadRoot: "+err.Error())
+		}
+		threadRoot = id.EventID(root)
+	}
+	headerContent.RelatesTo = threadRelation(threadRoot)
+
+	var eventIDs []id.EventID
+	resp, err := sendMessageEventAs(puppet, roomID, event.EventMessage, &headerContent)
+	if err == nil {
+		eventIDs = append(eventIDs, resp.EventID)
+		if len(threadRoot) == 0 {
+			//the first email of a conversation is the root of its thread
+			threadRoot = resp.EventID
+		}
+	}
 
+	bodyContent := &event.MessageEventContent{
+		Body:      content.body,
+		MsgType:   event.MsgText,
+		RelatesTo: threadRelation(threadRoot),
+	}
 	if content.htmlFormat {
-		bodyContent := &event.MessageEventContent{
-			Format:        event.FormatHTML,
-			Body:          content.body,
-			FormattedBody: string(markdown.ToHTML([]byte(content.body), nil, nil)),
-			MsgType:       event.MsgText,
+		bodyContent.Format = event.FormatHTML
+		bodyContent.FormattedBody = content.formattedBody
+	}
+	resp, err = sendMessageEventAs(puppet, roomID, event.EventMessage, &bodyContent)
+	if err == nil {
+		eventIDs = append(eventIDs, resp.EventID)
+	}
+
+	for _, attachment := range content.attachments {
+		if eventID := sendAttachment(roomID.String(), attachment, threadRoot, puppet); len(eventID) > 0 {
+			eventIDs = append(eventIDs, eventID)
 		}
-		matrixClient.SendMessageEvent(id.RoomID(account.roomID), event.EventMessage, &bodyContent)
-	} else {
-		matrixClient.SendText(id.RoomID(account.roomID), content.body)
 	}
+
+	replyAddress := content.replyTo
+	if len(replyAddress) == 0 && len(content.sendermails) > 0 {
+		replyAddress = content.sendermails[0]
+	}
+	for _, eventID := range eventIDs {
+		err = saveBridgedMail(bridgedMail{
+			roomPKID:          account.roomPKID,
+			eventID:           eventID.String(),
+			messageID:         content.messageID,
+			subject:           content.subject,
+			sender:            replyAddress,
+			references:        strings.Join(content.references, " "),
+			mailbox:           account.mailbox,
+			uidValidity:       uidValidity,
+			uid:               mail.Uid,
+			threadRoot:        threadRoot.String(),
+			normalizedSubject: normalizedSubject,
+			portal:            portalPK,
+		})
+		if err != nil {
+			WriteLog(logError, "#80 saveBridgedMail: "+err.Error())
+		}
+	}
+}
+
+func reverse(list []string) []string {
+	reversed := make([]string, len(list))
+	for i, item := range list {
+		reversed[len(list)-1-i] = item
+	}
+	return reversed
+}
+
+//getReplacedEvent returns the ID of the event a message edits
+func getReplacedEvent(evt *event.Event) id.EventID {
+	relatesTo, ok := evt.Content.Raw["m.relates_to"].(map[string]interface{})
+	if !ok || relatesTo["rel_type"] != string(event.RelReplace) {
+		return ""
+	}
+	eventID, _ := relatesTo["event_id"].(string)
+	return id.EventID(eventID)
+}
+
+//getInReplyTo returns the ID of the event a message explicitly replies to.
+//The reply fallback of messages in a thread (is_falling_back) doesn't count as reply
+func getInReplyTo(evt *event.Event) id.EventID {
+	relatesTo, ok := evt.Content.Raw["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if fallingBack, _ := relatesTo["is_falling_back"].(bool); fallingBack {
+		return ""
+	}
+	inReplyTo, ok := relatesTo["m.in_reply_to"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	eventID, _ := inReplyTo["event_id"].(string)
+	return id.EventID(eventID)
 }
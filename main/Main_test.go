@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const testRoom = id.RoomID("!room:example.org")
+
+//setupTestDB creates an in-memory database, a log file and a master key
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	var err error
+	logfile, err = os.Create(filepath.Join(dir, "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logfile.Close() })
+
+	db, err = sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every connection would get its own in-memory database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	createAllTables()
+
+	masterKey = []byte("0123456789abcdef0123456789abcdef")
+}
+
+//setupTestMatrix starts a fake homeserver serving mux which lets the bridge post into testRoom.
+//The returned function lists the sent messages
+func setupTestMatrix(t *testing.T, mux *http.ServeMux) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mutex sync.Mutex
+	var sent []string
+	mux.HandleFunc("/_matrix/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/send/") {
+			http.NotFound(w, r)
+			return
+		}
+		var content event.MessageEventContent
+		json.NewDecoder(r.Body).Decode(&content)
+		mutex.Lock()
+		sent = append(sent, content.Body)
+		mutex.Unlock()
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client, err := mautrix.NewClient(server.URL, "@bridge:example.org", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrixClient = client
+	store = &FileStore{
+		path:  filepath.Join(t.TempDir(), "store.json"),
+		Rooms: make(map[id.RoomID]*mautrix.Room),
+		//the room is known to be unencrypted, no state request needed
+		Encryption: map[id.RoomID]*event.EncryptionEventContent{testRoom: nil},
+	}
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return sent
+	}
+}
+
+//setupTestIMAP starts an IMAP server with the in-memory backend and logs in.
+//Its INBOX initially holds a single mail with the UID 6
+func setupTestIMAP(t *testing.T) (*client.Client, backend.User) {
+	t.Helper()
+	be := memory.New()
+	imapServer := server.New(moveBackend{be})
+	imapServer.AllowInsecureAuth = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go imapServer.Serve(listener)
+	t.Cleanup(func() { imapServer.Close() })
+
+	mClient, err := client.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mClient.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mClient.Logout() })
+
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mClient, user
+}
+
+//moveBackend adds the MOVE extension to the in-memory backend
+type moveBackend struct {
+	*memory.Backend
+}
+
+func (be moveBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return moveUser{user}, nil
+}
+
+type moveUser struct {
+	backend.User
+}
+
+func (u moveUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return moveMailbox{mbox.(*memory.Mailbox)}, nil
+}
+
+type moveMailbox struct {
+	*memory.Mailbox
+}
+
+func (mbox moveMailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if err := mbox.CopyMessages(uid, seqSet, dest); err != nil {
+		return err
+	}
+	var kept []*memory.Message
+	for i, msg := range mbox.Messages {
+		id := msg.Uid
+		if !uid {
+			id = uint32(i + 1)
+		}
+		if !seqSet.Contains(id) {
+			kept = append(kept, msg)
+		}
+	}
+	mbox.Messages = kept
+	return nil
+}
+
+//serveTestMailTasks runs the mail tasks of testRoom on mClient
+func serveTestMailTasks(t *testing.T, mClient *client.Client) {
+	t.Helper()
+	tasks := make(chan *mailTask)
+	quit := make(chan bool)
+	listenerMutex.Lock()
+	mailTasks[testRoom.String()] = tasks
+	listenerMutex.Unlock()
+	go func() {
+		for {
+			select {
+			case task := <-tasks:
+				task.done <- task.run(mClient)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(quit)
+		listenerMutex.Lock()
+		delete(mailTasks, testRoom.String())
+		listenerMutex.Unlock()
+	})
+}
+
+//addTestMail stores a new mail in the mailbox of the IMAP test server
+func addTestMail(t *testing.T, user backend.User, mailbox, subject string) {
+	t.Helper()
+	mbox, err := user.GetMailbox(mailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "From: sender@example.org\r\n" +
+		"To: me@example.org\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Message-ID: <" + strings.ReplaceAll(subject, " ", "") + "@example.org>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello"
+	if err = mbox.CreateMessage(nil, time.Now(), strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//testSMTPServer is a minimal smtp server recording the commands and mails it receives
+type testSMTPServer struct {
+	addr        string
+	extensions  []string
+	implicitTLS bool
+	authReply   string
+	quitReply   string
+	tlsConfig   *tls.Config
+
+	mutex    sync.Mutex
+	commands []string
+	mails    []string
+}
+
+//setupTestSMTP starts an smtp server advertising the given extensions.
+//dialSMTP connects to it, regardless of the address
+func setupTestSMTP(t *testing.T, extensions ...string) *testSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	//borrow the self-signed certificate of httptest
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsServer.Close()
+	smtpServer := &testSMTPServer{
+		addr:       listener.Addr().String(),
+		extensions: extensions,
+		authReply:  "235 2.7.0 Authentication successful",
+		quitReply:  "221 Bye",
+		tlsConfig:  &tls.Config{Certificates: tlsServer.TLS.Certificates},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go smtpServer.serve(conn)
+		}
+	}()
+	dialSMTP = func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, smtpServer.addr)
+	}
+	t.Cleanup(func() { dialSMTP = (&net.Dialer{Timeout: 30 * time.Second}).Dial })
+	return smtpServer
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	isTLS := s.implicitTLS
+	if isTLS {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 test ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, args, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		s.record(&s.commands, strings.TrimSpace(verb+" "+strings.SplitN(args, " ", 2)[0]))
+		switch verb {
+		case "EHLO", "HELO":
+			lines := []string{"test"}
+			for _, extension := range s.extensions {
+				if extension != "STARTTLS" || !isTLS {
+					lines = append(lines, extension)
+				}
+			}
+			for i, l := range lines {
+				if i < len(lines)-1 {
+					text.PrintfLine("250-%s", l)
+				} else {
+					text.PrintfLine("250 %s", l)
+				}
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			conn = tls.Server(conn, s.tlsConfig)
+			text = textproto.NewConn(conn)
+			isTLS = true
+		case "AUTH":
+			if strings.HasPrefix(strings.ToUpper(args), "LOGIN") {
+				text.PrintfLine("334 VXNlcm5hbWU6")
+				text.ReadLine()
+				text.PrintfLine("334 UGFzc3dvcmQ6")
+				text.ReadLine()
+			}
+			text.PrintfLine(s.authReply)
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			lines, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+			s.record(&s.mails, strings.Join(lines, "\r\n"))
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine(s.quitReply)
+			return
+		default:
+			text.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+func (s *testSMTPServer) record(list *[]string, entry string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	*list = append(*list, entry)
+}
+
+//received returns the commands and mails the server received
+func (s *testSMTPServer) received() (commands, mails []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.commands...), append([]string(nil), s.mails...)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+func TestGetInReplyTo(t *testing.T) {
+	tests := []struct {
+		name      string
+		relatesTo string
+		want      id.EventID
+	}{
+		{"no relation", ``, ""},
+		{"reply", `"m.relates_to":{"m.in_reply_to":{"event_id":"$mail"}},`, "$mail"},
+		{"explicit reply in thread", `"m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":false,"m.in_reply_to":{"event_id":"$mail"}},`, "$mail"},
+		{"thread fallback", `"m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$mail"}},`, ""},
+	}
+	for _, test := range tests {
+		evt := &event.Event{Type: event.EventMessage}
+		if err := json.Unmarshal([]byte(`{`+test.relatesTo+`"msgtype":"m.text","body":"hello"}`), &evt.Content); err != nil {
+			t.Fatal(err)
+		}
+		if got := getInReplyTo(evt); got != test.want {
+			t.Errorf("%s: getInReplyTo = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//sendMessageEvent sends an event into a room. Events for encrypted rooms get encrypted
+func sendMessageEvent(roomID id.RoomID, eventType event.Type, content interface{}) (*mautrix.RespSendEvent, error) {
+	if store.IsEncrypted(roomID) {
+		encrypted, err := encryptEvent(roomID, eventType, content)
+		if err != nil {
+			WriteLog(logError, "#117 encrypting event for "+roomID.String()+": "+err.Error())
+			return nil, err
+		}
+		return matrixClient.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+	}
+	return matrixClient.SendMessageEvent(roomID, eventType, content)
+}
+
+func sendText(roomID id.RoomID, text string) (*mautrix.RespSendEvent, error) {
+	return sendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: text})
+}
+
+func sendNotice(roomID id.RoomID, text string) (*mautrix.RespSendEvent, error) {
+	return sendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgNotice, Body: text})
+}
+
+func sendReaction(roomID id.RoomID, eventID id.EventID, reaction string) (*mautrix.RespSendEvent, error) {
+	return sendMessageEvent(roomID, event.EventReaction, &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: eventID, Key: reaction},
+	})
+}
+
+//uploadMedia uploads a file for a room. In encrypted rooms the file gets encrypted and
+//the returned file info has to be used instead of the url
+func uploadMedia(roomID id.RoomID, data []byte, mimeType, filename string) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	if !store.IsEncrypted(roomID) {
+		resp, err := matrixClient.UploadBytesWithName(data, mimeType, filename)
+		if err != nil {
+			return "", nil, err
+		}
+		return resp.ContentURI.CUString(), nil, nil
+	}
+
+	file := attachment.NewEncryptedFile()
+	resp, err := matrixClient.UploadBytes(file.Encrypt(data), "application/octet-stream")
+	if err != nil {
+		return "", nil, err
+	}
+	return "", &event.EncryptedFileInfo{EncryptedFile: *file, URL: resp.ContentURI.CUString()}, nil
+}
+
+//downloadMedia downloads the file of a message and decrypts it if required
+func downloadMedia(content *event.MessageEventContent) (io.ReadCloser, error) {
+	contentURL := content.URL
+	if content.File != nil {
+		contentURL = content.File.URL
+	}
+	uri, err := contentURL.Parse()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := matrixClient.Download(uri)
+	if err != nil || content.File == nil {
+		return reader, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := content.File.Decrypt(data)
+	if err != nil {
+		return nil, errors.New("couldn't decrypt file: " + err.Error())
+	}
+	return ioutil.NopCloser(bytes.NewReader(plain)), nil
+}
+
+//handleEncryptedEvent decrypts an event and passes it to the handler of the decrypted event type
+func handleEncryptedEvent(source mautrix.EventSource, evt *event.Event) {
+	if evt.Sender == matrixClient.UserID {
+		return
+	}
+	decrypted, err := decryptEvent(evt)
+	if err != nil {
+		WriteLog(logError, "#118 decrypting event "+evt.ID.String()+": "+err.Error())
+		notifyUndecryptable(evt)
+		return
+	}
+
+	//relations are sent unencrypted, the reply and thread helpers read them from the raw content
+	if relatesTo, ok := evt.Content.Raw["m.relates_to"]; ok {
+		if decrypted.Content.Raw == nil {
+			decrypted.Content.Raw = make(map[string]interface{})
+		}
+		if _, ok := decrypted.Content.Raw["m.relates_to"]; !ok {
+			decrypted.Content.Raw["m.relates_to"] = relatesTo
+		}
+	}
+
+	if decrypted.Type == event.EventMessage {
+		handleMessageEvent(source, decrypted)
+	}
+}
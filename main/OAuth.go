@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix/id"
+)
+
+//authentication methods of mail accounts
+const (
+	authPassword    = "password"
+	authXOAuth2     = "xoauth2"
+	authOAuthBearer = "oauthbearer"
+)
+
+//tokens expiring within this duration get refreshed before they are used
+const tokenRefreshMargin = 5 * time.Minute
+
+//oauthProvider holds the endpoints and client credentials of an OAuth2 provider (configured in cfg.json)
+type oauthProvider struct {
+	DeviceAuthURL string `mapstructure:"deviceauthurl"`
+	TokenURL      string `mapstructure:"tokenurl"`
+	ClientID      string `mapstructure:"clientid"`
+	ClientSecret  string `mapstructure:"clientsecret"`
+	Scope         string `mapstructure:"scope"`
+}
+
+//defaultOAuthProviders get written to cfg.json if no providers are configured
+var defaultOAuthProviders = map[string]map[string]string{
+	"google": {
+		"deviceauthurl": "https://oauth2.googleapis.com/device/code",
+		"tokenurl":      "https://oauth2.googleapis.com/token",
+		"clientid":      "",
+		"clientsecret":  "",
+		"scope":         "https://mail.google.com/",
+	},
+	"microsoft": {
+		"deviceauthurl": "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode",
+		"tokenurl":      "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		"clientid":      "",
+		"clientsecret":  "",
+		"scope":         "offline_access https://outlook.office.com/IMAP.AccessAsUser.All https://outlook.office.com/SMTP.Send",
+	},
+}
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURL         string `json:"verification_url"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+var tokenMutex sync.Mutex
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+//pollWait waits between the token requests of the device flow
+var pollWait = time.Sleep
+
+func getOAuthProvider(name string) (*oauthProvider, error) {
+	var providers map[string]oauthProvider
+	if err := viper.UnmarshalKey("oauthProviders", &providers); err != nil {
+		return nil, err
+	}
+	name = strings.ToLower(name)
+	provider, ok := providers[name]
+	if !ok {
+		return nil, errors.New("unknown oauth provider '" + name + "'")
+	}
+	if len(provider.TokenURL) == 0 || len(provider.DeviceAuthURL) == 0 || len(provider.ClientID) == 0 {
+		return nil, errors.New("the oauth provider '" + name + "' isn't configured completely. Ask your admin to set deviceauthurl, tokenurl and clientid in the cfg.json")
+	}
+	return &provider, nil
+}
+
+//parseOAuthPassword checks if the password given in !setup requests OAuth2 ("oauth:<provider>", "xoauth2:<provider>" or "oauthbearer:<provider>")
+func parseOAuthPassword(password string) (method, provider string, ok bool) {
+	prefix, provider, found := strings.Cut(password, ":")
+	if !found || len(provider) == 0 {
+		return "", "", false
+	}
+	switch strings.ToLower(prefix) {
+	case "oauth", authXOAuth2:
+		return authXOAuth2, strings.ToLower(provider), true
+	case authOAuthBearer:
+		return authOAuthBearer, strings.ToLower(provider), true
+	}
+	return "", "", false
+}
+
+//getOrCreateOAuthToken returns the token of an already authorized account or authorizes it using the device code flow
+func getOrCreateOAuthToken(roomID id.RoomID, providerName, username string) (int, error) {
+	tokenID, err := findOAuthToken(providerName, username)
+	if err != nil {
+		return -1, err
+	}
+	if tokenID != -1 {
+		return tokenID, nil
+	}
+	return authorizeDevice(roomID, providerName, username)
+}
+
+//authorizeDevice runs the OAuth2 device authorization grant (RFC 8628) and saves the received tokens
+func authorizeDevice(roomID id.RoomID, providerName, username string) (int, error) {
+	provider, err := getOAuthProvider(providerName)
+	if err != nil {
+		return -1, err
+	}
+
+	form := url.Values{"client_id": {provider.ClientID}, "scope": {provider.Scope}}
+	resp, err := httpClient.PostForm(provider.DeviceAuthURL, form)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	var device deviceCodeResponse
+	if err = json.NewDecoder(resp.Body).Decode(&device); err != nil {
+		return -1, err
+	}
+	if resp.StatusCode != http.StatusOK || len(device.DeviceCode) == 0 {
+		return -1, errors.New("requesting a device code failed: " + resp.Status)
+	}
+
+	verificationURI := device.VerificationURI
+	if len(verificationURI) == 0 {
+		verificationURI = device.VerificationURL
+	}
+	text := "To authorize the bridge for " + username + " open " + verificationURI + " and enter the code " + device.UserCode
+	if len(device.VerificationURIComplete) > 0 {
+		text += "\r\nor open " + device.VerificationURIComplete
+	}
+	sendText(roomID, text)
+
+	interval := time.Duration(device.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	expiresIn := time.Duration(device.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 15 * time.Minute
+	}
+	deadline := time.Now().Add(expiresIn)
+
+	for time.Now().Before(deadline) {
+		pollWait(interval)
+		token, err := requestToken(provider, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {device.DeviceCode},
+		})
+		if err != nil {
+			return -1, err
+		}
+		switch token.Error {
+		case "":
+			if len(token.RefreshToken) == 0 {
+				return -1, errors.New("the provider didn't send a refresh token")
+			}
+			id, err := insertOAuthToken(providerName, username, token.RefreshToken, token.AccessToken, tokenExpiry(token))
+			return int(id), err
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return -1, errors.New("authorization failed: " + token.Error + " " + token.ErrorDescription)
+		}
+	}
+	return -1, errors.New("the device code expired")
+}
+
+//requestToken sends a request to the token endpoint of the provider. OAuth errors are returned in the tokenResponse
+func requestToken(provider *oauthProvider, form url.Values) (*tokenResponse, error) {
+	form.Set("client_id", provider.ClientID)
+	if len(provider.ClientSecret) > 0 {
+		form.Set("client_secret", provider.ClientSecret)
+	}
+	resp, err := httpClient.PostForm(provider.TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var token tokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, errors.New("invalid response from token endpoint (" + resp.Status + "): " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK && len(token.Error) == 0 {
+		return nil, errors.New("token endpoint returned " + resp.Status)
+	}
+	return &token, nil
+}
+
+func tokenExpiry(token *tokenResponse) time.Time {
+	if token.ExpiresIn <= 0 {
+		return time.Now().Add(time.Hour)
+	}
+	return time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+}
+
+//getAccessToken returns a valid access token and refreshes it if it expires soon
+func getAccessToken(tokenID int) (string, error) {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+
+	providerName, refreshToken, accessToken, expiry, err := getOAuthToken(tokenID)
+	if err != nil {
+		return "", err
+	}
+	if len(accessToken) > 0 && time.Now().Add(tokenRefreshMargin).Before(expiry) {
+		return accessToken, nil
+	}
+
+	provider, err := getOAuthProvider(providerName)
+	if err != nil {
+		return "", err
+	}
+	token, err := requestToken(provider, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(token.Error) > 0 {
+		return "", errors.New("refreshing the access token failed: " + token.Error + " " + token.ErrorDescription)
+	}
+	//providers may rotate the refresh token
+	if len(token.RefreshToken) > 0 {
+		refreshToken = token.RefreshToken
+	}
+	if err = updateOAuthToken(tokenID, refreshToken, token.AccessToken, tokenExpiry(token)); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+//newSASLClient creates the SASL client of an OAuth2 account
+func newSASLClient(method, username string, tokenID int, host string) (sasl.Client, error) {
+	token, err := getAccessToken(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if method == authOAuthBearer {
+		hostname, portStr, err := net.SplitHostPort(host)
+		if err != nil {
+			hostname = host
+		}
+		port, _ := strconv.Atoi(portStr)
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{Username: username, Token: token, Host: hostname, Port: port}), nil
+	}
+	return &xoauth2Client{username, token}, nil
+}
+
+//xoauth2Client implements the XOAUTH2 mechanism used by Google and Microsoft
+type xoauth2Client struct {
+	username, token string
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	//the server sends an error as challenge, an empty response finishes the exchange
+	return []byte{}, nil
+}
+
+//saslAuth uses a SASL client for smtp authentication
+type saslAuth struct {
+	client sasl.Client
+}
+
+func (a *saslAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return a.client.Start()
+}
+
+func (a *saslAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return a.client.Next(fromServer)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+//setupTestProvider configures the oauth provider "test" using the endpoints of server
+func setupTestProvider(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	viper.Set("oauthProviders", map[string]map[string]string{
+		"test": {
+			"deviceauthurl": server.URL + "/device",
+			"tokenurl":      server.URL + "/token",
+			"clientid":      "client",
+			"clientsecret":  "secret",
+			"scope":         "mail",
+		},
+	})
+	t.Cleanup(func() { viper.Set("oauthProviders", nil) })
+}
+
+func TestAuthorizeDevice(t *testing.T) {
+	setupTestDB(t)
+	mux := http.NewServeMux()
+	server, sentMessages := setupTestMatrix(t, mux)
+	setupTestProvider(t, server)
+
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "client" || r.Form.Get("scope") != "mail" {
+			t.Errorf("device request: unexpected form %v", r.Form)
+		}
+		writeJSON(w, http.StatusOK, `{"device_code":"dev","user_code":"ABCD-1234","verification_uri":"https://example.org/device","expires_in":600,"interval":1}`)
+	})
+	var polls int
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" || r.Form.Get("device_code") != "dev" || r.Form.Get("client_secret") != "secret" {
+			t.Errorf("token request: unexpected form %v", r.Form)
+		}
+		polls++
+		switch polls {
+		case 1:
+			writeJSON(w, http.StatusBadRequest, `{"error":"authorization_pending"}`)
+		case 2:
+			writeJSON(w, http.StatusBadRequest, `{"error":"slow_down"}`)
+		default:
+			writeJSON(w, http.StatusOK, `{"access_token":"access","refresh_token":"refresh","expires_in":3600}`)
+		}
+	})
+
+	var waits []time.Duration
+	pollWait = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { pollWait = time.Sleep }()
+
+	tokenID, err := authorizeDevice(testRoom, "test", "me@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polls != 3 {
+		t.Errorf("token endpoint polled %d times, want 3", polls)
+	}
+	//slow_down increases the interval by 5 seconds
+	wantWaits := []time.Duration{time.Second, time.Second, 6 * time.Second}
+	if len(waits) != len(wantWaits) {
+		t.Fatalf("waits = %v, want %v", waits, wantWaits)
+	}
+	for i := range waits {
+		if waits[i] != wantWaits[i] {
+			t.Errorf("waits = %v, want %v", waits, wantWaits)
+			break
+		}
+	}
+
+	messages := sentMessages()
+	if len(messages) != 1 || !strings.Contains(messages[0], "ABCD-1234") || !strings.Contains(messages[0], "https://example.org/device") {
+		t.Errorf("sent messages = %q, want the user code and verification uri", messages)
+	}
+
+	provider, refreshToken, accessToken, expiry, err := getOAuthToken(tokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider != "test" || refreshToken != "refresh" || accessToken != "access" {
+		t.Errorf("stored token = %s, %s, %s", provider, refreshToken, accessToken)
+	}
+	if until := time.Until(expiry); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("token expires in %v, want 1h", until)
+	}
+}
+
+func TestAuthorizeDeviceDenied(t *testing.T) {
+	setupTestDB(t)
+	mux := http.NewServeMux()
+	server, _ := setupTestMatrix(t, mux)
+	setupTestProvider(t, server)
+
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, `{"device_code":"dev","user_code":"ABCD-1234","verification_uri":"https://example.org/device"}`)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusBadRequest, `{"error":"access_denied","error_description":"the user declined"}`)
+	})
+	pollWait = func(time.Duration) {}
+	defer func() { pollWait = time.Sleep }()
+
+	if _, err := authorizeDevice(testRoom, "test", "me@example.org"); err == nil || !strings.Contains(err.Error(), "access_denied") {
+		t.Errorf("err = %v, want access_denied", err)
+	}
+	if tokenID, _ := findOAuthToken("test", "me@example.org"); tokenID != -1 {
+		t.Errorf("a token was saved although the authorization failed")
+	}
+}
+
+func TestGetAccessToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		expiresIn   time.Duration
+		response    string
+		status      int
+		wantRequest bool
+		wantAccess  string
+		wantRefresh string
+		wantErr     bool
+	}{
+		{"valid", time.Hour, "", 0, false, "access", "refresh", false},
+		{"within refresh margin", tokenRefreshMargin - time.Minute, `{"access_token":"new","expires_in":3600}`, http.StatusOK, true, "new", "refresh", false},
+		{"expired", -time.Minute, `{"access_token":"new","expires_in":3600}`, http.StatusOK, true, "new", "refresh", false},
+		{"rotated refresh token", time.Minute, `{"access_token":"new","refresh_token":"rotated","expires_in":3600}`, http.StatusOK, true, "new", "rotated", false},
+		{"refresh rejected", time.Minute, `{"error":"invalid_grant"}`, http.StatusBadRequest, true, "access", "refresh", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDB(t)
+			var requested bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = true
+				r.ParseForm()
+				if r.URL.Path != "/token" || r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" || r.Form.Get("client_id") != "client" {
+					t.Errorf("unexpected request %s %v", r.URL.Path, r.Form)
+				}
+				writeJSON(w, test.status, test.response)
+			}))
+			defer server.Close()
+			setupTestProvider(t, server)
+
+			tokenID, err := insertOAuthToken("test", "me@example.org", "refresh", "access", time.Now().Add(test.expiresIn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			accessToken, err := getAccessToken(int(tokenID))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, test.wantErr)
+			}
+			if requested != test.wantRequest {
+				t.Errorf("token endpoint requested: %v, want %v", requested, test.wantRequest)
+			}
+			if !test.wantErr && accessToken != test.wantAccess {
+				t.Errorf("access token = %q, want %q", accessToken, test.wantAccess)
+			}
+
+			_, refreshToken, storedAccess, _, err := getOAuthToken(int(tokenID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if storedAccess != test.wantAccess || refreshToken != test.wantRefresh {
+				t.Errorf("stored tokens = %q, %q, want %q, %q", storedAccess, refreshToken, test.wantAccess, test.wantRefresh)
+			}
+		})
+	}
+}
+
+func TestParseOAuthPassword(t *testing.T) {
+	tests := []struct {
+		password, method, provider string
+		ok                         bool
+	}{
+		{"oauth:Google", authXOAuth2, "google", true},
+		{"xoauth2:microsoft", authXOAuth2, "microsoft", true},
+		{"OAUTHBEARER:Google", authOAuthBearer, "google", true},
+		{"oauth:", "", "", false},
+		{"secret", "", "", false},
+		{"pass:word", "", "", false},
+	}
+	for _, test := range tests {
+		method, provider, ok := parseOAuthPassword(test.password)
+		if method != test.method || provider != test.provider || ok != test.ok {
+			t.Errorf("parseOAuthPassword(%q) = %q, %q, %v, want %q, %q, %v", test.password, method, provider, ok, test.method, test.provider, test.ok)
+		}
+	}
+}
+
+func TestXOAuth2InitialResponse(t *testing.T) {
+	setupTestDB(t)
+	tokenID, err := insertOAuthToken("test", "me@example.org", "refresh", "token", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newSASLClient(authXOAuth2, "me@example.org", int(tokenID), "imap.example.org:993")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mech, ir, err := client.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "XOAUTH2" {
+		t.Errorf("mechanism = %q, want XOAUTH2", mech)
+	}
+	if want := "user=me@example.org\x01auth=Bearer token\x01\x01"; string(ir) != want {
+		t.Errorf("initial response = %q, want %q", ir, want)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//delays between the attempts to send a queued email
+const (
+	outboxRetryDelay    = time.Minute
+	outboxMaxRetryDelay = 6 * time.Hour
+	outboxMaxAttempts   = 10
+	outboxCheckInterval = 30 * time.Second
+)
+
+//outboxTrigger makes the outbox send due emails immediately
+var outboxTrigger = make(chan bool, 1)
+
+//startOutbox sends the queued emails in the background
+func startOutbox() {
+	go func() {
+		for {
+			sendDueMails()
+			select {
+			case <-outboxTrigger:
+			case <-time.After(outboxCheckInterval):
+			}
+		}
+	}()
+}
+
+func triggerOutbox() {
+	select {
+	case outboxTrigger <- true:
+	default:
+	}
+}
+
+//time format of scheduled emails
+const scheduleTimeFormat = "2006-01-02 15:04"
+
+//queueMail serializes the email including its attachments and puts it into the outbox of the room.
+//It gets sent at sendAt or immediately if sendAt is zero
+func queueMail(roomID string, m *gomail.Message, subject string, sendAt time.Time) error {
+	from, err := mail.ParseAddress(firstHeader(m, "From"))
+	if err != nil {
+		return err
+	}
+	var recipients []string
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, value := range m.GetHeader(field) {
+			address, err := mail.ParseAddress(value)
+			if err != nil {
+				return err
+			}
+			recipients = append(recipients, address.Address)
+		}
+	}
+
+	status := outboxQueued
+	var nextAttempt int64
+	if !sendAt.IsZero() {
+		status = outboxScheduled
+		nextAttempt = sendAt.Unix()
+		m.SetDateHeader("Date", sendAt)
+	}
+
+	var message bytes.Buffer
+	if _, err = m.WriteTo(&message); err != nil {
+		return err
+	}
+	_, err = insertOutboxMail(roomID, from.Address, strings.Join(recipients, ","), subject, message.Bytes(), status, nextAttempt)
+	if err != nil {
+		return err
+	}
+	triggerOutbox()
+	return nil
+}
+
+//parseSendTime parses the arguments of !send: "at <time>" or "in <duration>"
+func parseSendTime(args string, now time.Time) (time.Time, error) {
+	mode, value, _ := strings.Cut(strings.TrimSpace(args), " ")
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch mode {
+	case "in":
+		var duration time.Duration
+		var err error
+		if days := strings.TrimSuffix(value, "d"); days != value {
+			var n int
+			n, err = strconv.Atoi(days)
+			duration = time.Duration(n) * 24 * time.Hour
+		} else {
+			duration, err = time.ParseDuration(value)
+		}
+		if err != nil || duration <= 0 {
+			return time.Time{}, errors.New("invalid duration " + value + ", use e.g. 30m, 2h30m or 1d")
+		}
+		return now.Add(duration), nil
+	case "at":
+		if sendAt, err := time.ParseInLocation(scheduleTimeFormat, value, now.Location()); err == nil {
+			if !sendAt.After(now) {
+				return time.Time{}, errors.New(value + " is in the past")
+			}
+			return sendAt, nil
+		}
+		//a time of day means its next occurrence
+		for _, layout := range []string{"15:04", "3pm", "3:04pm"} {
+			clock, err := time.ParseInLocation(layout, value, now.Location())
+			if err != nil {
+				continue
+			}
+			sendAt := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+			if !sendAt.After(now) {
+				sendAt = sendAt.AddDate(0, 0, 1)
+			}
+			return sendAt, nil
+		}
+		return time.Time{}, errors.New("invalid time " + value + ", use e.g. 08:00, 8am or " + now.Format(scheduleTimeFormat))
+	}
+	return time.Time{}, errors.New("usage: !send at <time> or !send in <duration>")
+}
+
+func firstHeader(m *gomail.Message, field string) string {
+	if values := m.GetHeader(field); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func sendDueMails() {
+	mails, err := getDueOutboxMails(time.Now().Unix())
+	if err != nil {
+		WriteLog(logError, "#141 getDueOutboxMails: "+err.Error())
+		return
+	}
+	paused := make(map[string]bool)
+	for _, queued := range mails {
+		if queued.status == outboxScheduled {
+			//from now on the email is treated like any other queued one
+			queued.status = outboxQueued
+			if err = updateOutboxMail(queued.pk, outboxQueued, 0, queued.nextAttempt, ""); err != nil {
+				WriteLog(logError, "#147 updateOutboxMail: "+err.Error())
+				continue
+			}
+		}
+		//all emails of a room get paused after its login failed
+		if !paused[queued.roomID] {
+			paused[queued.roomID] = !sendOutboxMail(queued)
+		}
+	}
+}
+
+//sendOutboxMail tries to send a queued email. Returns false if the emails of the room got paused
+func sendOutboxMail(queued outboxMail) bool {
+	roomID := id.RoomID(queued.roomID)
+	account, err := getSMTPAccount(queued.roomID)
+	if err == sql.ErrNoRows {
+		pauseOutbox(queued.roomID, "no SMTP account")
+		sendNotice(roomID, "Can't send \""+queued.subject+"\": there is no SMTP account for this room. Set it up with !setup smtp and type !outbox retry")
+		return false
+	} else if err != nil {
+		WriteLog(critical, "#142 getSMTPAccount: "+err.Error())
+		return true
+	}
+
+	err = smtpSend(account, queued.sender, strings.Split(queued.recipients, ","), bytes.NewReader(queued.message))
+	if err == nil {
+		if _, err = deleteOutboxMail(queued.roomID, queued.pk); err != nil {
+			WriteLog(logError, "#143 deleteOutboxMail: "+err.Error())
+		}
+		sendNotice(roomID, "Email \""+queued.subject+"\" sent successfully")
+		return true
+	}
+	WriteLog(logError, "#46 sending queued email: "+err.Error())
+
+	var smtpErr *textproto.Error
+	isSMTPErr := errors.As(err, &smtpErr)
+	if isSMTPErr && smtpErr.Code == 535 {
+		//the account is only removed if the user wants to, the error might be temporary
+		pauseOutbox(queued.roomID, err.Error())
+		sendNotice(roomID, "The SMTP server rejected the login: "+err.Error()+"\r\nIf your credentials changed, type !outbox relogin to remove the SMTP account and set it up again. Queued emails are kept, send them with !outbox retry")
+		return false
+	}
+
+	attempts := queued.attempts + 1
+	if (isSMTPErr && smtpErr.Code >= 500) || attempts >= outboxMaxAttempts {
+		//permanent errors won't go away by retrying
+		updateOutboxMail(queued.pk, outboxFailed, attempts, 0, err.Error())
+		sendNotice(roomID, "Couldn't send \""+queued.subject+"\": "+err.Error()+"\r\nType !outbox retry "+strconv.Itoa(queued.pk)+" to try again or !outbox cancel "+strconv.Itoa(queued.pk)+" to delete it")
+		return true
+	}
+
+	delay := outboxRetryDelay << uint(queued.attempts)
+	if delay > outboxMaxRetryDelay || delay <= 0 {
+		delay = outboxMaxRetryDelay
+	}
+	updateOutboxMail(queued.pk, outboxQueued, attempts, time.Now().Add(delay).Unix(), err.Error())
+	if attempts == 1 {
+		sendNotice(roomID, "Couldn't send \""+queued.subject+"\": "+err.Error()+"\r\nIt stays in the outbox and gets sent again automatically. Type !outbox to see its state")
+	}
+	return true
+}
+
+//outbox lists, retries and deletes the queued emails of a room
+func outbox(evt *event.Event, message string) {
+	//replies written in portals are queued for their bridged room
+	roomID := id.RoomID(controlRoomID(evt.RoomID.String()))
+	action, number, _ := strings.Cut(strings.TrimSpace(message), " ")
+	number = strings.TrimSpace(number)
+	switch action {
+	case "":
+		mails, err := getOutboxMails(roomID.String())
+		if err != nil {
+			WriteLog(critical, "#144 getOutboxMails: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #144")
+			return
+		}
+		if len(mails) == 0 {
+			sendText(roomID, "The outbox is empty")
+			return
+		}
+		text := "Outbox:\r\n"
+		for _, queued := range mails {
+			text += strconv.Itoa(queued.pk) + ": " + queued.subject + " to " + strings.ReplaceAll(queued.recipients, ",", ", ") + " - " + queued.status
+			if queued.status == outboxScheduled {
+				text += " for " + time.Unix(queued.nextAttempt, 0).Format(scheduleTimeFormat)
+			} else if queued.status == outboxQueued && queued.attempts > 0 {
+				text += ", next attempt " + time.Unix(queued.nextAttempt, 0).Format(scheduleTimeFormat)
+			}
+			if len(queued.lastError) > 0 {
+				text += " (" + queued.lastError + ")"
+			}
+			text += "\r\n"
+		}
+		sendText(roomID, text+"!outbox retry (number) sends an email again, !outbox cancel (number) deletes it")
+	case "retry":
+		pk := -1
+		if len(number) > 0 {
+			var err error
+			if pk, err = strconv.Atoi(number); err != nil {
+				sendText(roomID, "Usage: !outbox retry (number)")
+				return
+			}
+		}
+		count, err := retryOutbox(roomID.String(), pk)
+		if err != nil {
+			WriteLog(critical, "#145 retryOutbox: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #145")
+			return
+		}
+		if count == 0 {
+			sendText(roomID, "There is nothing to send")
+			return
+		}
+		sendText(roomID, "Sending "+strconv.FormatInt(count, 10)+" email(s) again")
+		triggerOutbox()
+	case "cancel":
+		pk, err := strconv.Atoi(number)
+		if err != nil {
+			sendText(roomID, "Usage: !outbox cancel (number)")
+			return
+		}
+		count, err := deleteOutboxMail(roomID.String(), pk)
+		if err != nil {
+			WriteLog(critical, "#146 deleteOutboxMail: "+err.Error())
+			sendText(roomID, "An server-error occured Errorcode: #146")
+			return
+		}
+		if count == 0 {
+			sendText(roomID, "There is no email "+number+" in the outbox")
+			return
+		}
+		sendText(roomID, "Email deleted from the outbox")
+	case "relogin":
+		removeSMTPAccount(roomID.String())
+		sendText(roomID, "SMTP account removed. Set it up again with !setup smtp and send the queued emails with !outbox retry")
+	default:
+		sendText(roomID, "Usage: !outbox, !outbox retry (number), !outbox cancel (number) or !outbox relogin")
+	}
+}
+
+//scheduled lists the scheduled emails of a room
+func scheduled(evt *event.Event, message string) {
+	//the scheduled emails of a portal are the ones of its bridged room
+	roomID := id.RoomID(controlRoomID(evt.RoomID.String()))
+	mails, err := getOutboxMails(roomID.String())
+	if err != nil {
+		WriteLog(critical, "#148 getOutboxMails: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #148")
+		return
+	}
+	text := "Scheduled emails:\r\n"
+	var count int
+	for _, queued := range mails {
+		if queued.status != outboxScheduled {
+			continue
+		}
+		count++
+		text += strconv.Itoa(queued.pk) + ": " + time.Unix(queued.nextAttempt, 0).Format(scheduleTimeFormat) + " - " + queued.subject + " to " + strings.ReplaceAll(queued.recipients, ",", ", ") + "\r\n"
+	}
+	if count == 0 {
+		sendText(roomID, "There are no scheduled emails")
+		return
+	}
+	sendText(roomID, text+"Cancel one with !unschedule (number)")
+}
+
+//unschedule cancels a scheduled email
+func unschedule(evt *event.Event, message string) {
+	roomID := id.RoomID(controlRoomID(evt.RoomID.String()))
+	pk, err := strconv.Atoi(strings.TrimSpace(message))
+	if err != nil {
+		sendText(roomID, "Usage: !unschedule (number)")
+		return
+	}
+	count, err := unscheduleMail(roomID.String(), pk)
+	if err != nil {
+		WriteLog(critical, "#149 unscheduleMail: "+err.Error())
+		sendText(roomID, "An server-error occured Errorcode: #149")
+		return
+	}
+	if count == 0 {
+		sendText(roomID, "There is no scheduled email "+strings.TrimSpace(message)+". Type !scheduled to see all scheduled emails")
+		return
+	}
+	sendText(roomID, "Scheduled email deleted")
+}
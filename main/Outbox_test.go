@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+//setupTestOutbox creates testRoom with an smtp account on the test server and queues an email
+func setupTestOutbox(t *testing.T, attempts int, extensions ...string) (*testSMTPServer, outboxMail, func() []string) {
+	t.Helper()
+	setupTestDB(t)
+	_, sentMessages := setupTestMatrix(t, http.NewServeMux())
+	smtpServer := setupTestSMTP(t, extensions...)
+	if _, err := db.Exec("INSERT INTO rooms (roomID) VALUES(?)", testRoom.String()); err != nil {
+		t.Fatal(err)
+	}
+	accountID, err := insertSMTPAccountount("localhost", 25, "me", "secret", false, securityPlain, authPassword, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = saveSMTPAcc(testRoom.String(), int(accountID)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = insertOutboxMail(testRoom.String(), "me@example.org", "you@example.org", "Hello", []byte("Subject: Hello\r\n\r\nHello you"), outboxQueued, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("UPDATE outbox SET attempts=?", attempts); err != nil {
+		t.Fatal(err)
+	}
+	mails, err := getOutboxMails(testRoom.String())
+	if err != nil || len(mails) != 1 {
+		t.Fatalf("getOutboxMails = %v, %v", mails, err)
+	}
+	return smtpServer, mails[0], sentMessages
+}
+
+func TestSendOutboxMail(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     int
+		authReply    string
+		wantContinue bool
+		wantStatus   string
+		wantAttempts int
+		wantDelay    time.Duration
+		wantNotice   string
+	}{
+		{"sent", 0, "", true, "", 0, 0, "Email \"Hello\" sent successfully"},
+		{"temporary error", 0, "454 4.7.0 Temporary authentication failure", true, outboxQueued, 1, time.Minute, "It stays in the outbox"},
+		{"backoff", 3, "454 4.7.0 Temporary authentication failure", true, outboxQueued, 4, 8 * time.Minute, ""},
+		{"too many attempts", outboxMaxAttempts - 1, "454 4.7.0 Temporary authentication failure", true, outboxFailed, outboxMaxAttempts, 0, "Couldn't send \"Hello\""},
+		{"rejected login", 0, "535 5.7.8 Authentication credentials invalid", false, outboxPaused, 0, 0, "The SMTP server rejected the login"},
+		{"permanent error", 0, "550 5.7.1 Not allowed", true, outboxFailed, 1, 0, "Couldn't send \"Hello\""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			smtpServer, queued, sentMessages := setupTestOutbox(t, test.attempts, "AUTH PLAIN")
+			if len(test.authReply) > 0 {
+				smtpServer.authReply = test.authReply
+			}
+
+			start := time.Now()
+			if got := sendOutboxMail(queued); got != test.wantContinue {
+				t.Errorf("sendOutboxMail = %v, want %v", got, test.wantContinue)
+			}
+			mails, err := getOutboxMails(testRoom.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(test.wantStatus) == 0 {
+				if len(mails) != 0 {
+					t.Errorf("sent email is still in the outbox: %+v", mails)
+				}
+			} else if len(mails) != 1 || mails[0].status != test.wantStatus || mails[0].attempts != test.wantAttempts {
+				t.Errorf("outbox = %+v, want status %s after %d attempts", mails, test.wantStatus, test.wantAttempts)
+			} else if test.wantDelay > 0 {
+				next := time.Unix(mails[0].nextAttempt, 0)
+				if next.Before(start.Add(test.wantDelay-time.Second)) || next.After(time.Now().Add(test.wantDelay)) {
+					t.Errorf("next attempt in %v, want %v", next.Sub(start), test.wantDelay)
+				}
+			}
+
+			messages := sentMessages()
+			if len(test.wantNotice) == 0 && len(messages) > 0 {
+				t.Errorf("notices = %q, want none", messages)
+			} else if len(test.wantNotice) > 0 && (len(messages) != 1 || !strings.Contains(messages[0], test.wantNotice)) {
+				t.Errorf("notices = %q, want %q", messages, test.wantNotice)
+			}
+		})
+	}
+}
+
+func TestSendOutboxMailQuitError(t *testing.T) {
+	smtpServer, queued, _ := setupTestOutbox(t, 0, "AUTH PLAIN")
+	smtpServer.quitReply = "421 4.4.2 Connection dropped"
+	if !sendOutboxMail(queued) {
+		t.Errorf("sendOutboxMail paused the outbox")
+	}
+	if mails, _ := getOutboxMails(testRoom.String()); len(mails) != 0 {
+		t.Errorf("the accepted email is still in the outbox: %+v", mails)
+	}
+	if _, mails := smtpServer.received(); len(mails) != 1 {
+		t.Errorf("the server received %d emails, want 1", len(mails))
+	}
+}
+
+func TestSendOutboxMailWithoutAccount(t *testing.T) {
+	_, queued, sentMessages := setupTestOutbox(t, 0)
+	removeSMTPAccount(testRoom.String())
+	if sendOutboxMail(queued) {
+		t.Errorf("sendOutboxMail without an smtp account didn't pause the outbox")
+	}
+	if mails, _ := getOutboxMails(testRoom.String()); len(mails) != 1 || mails[0].status != outboxPaused {
+		t.Errorf("outbox = %+v, want the email paused", mails)
+	}
+	if messages := sentMessages(); len(messages) != 1 || !strings.Contains(messages[0], "there is no SMTP account") {
+		t.Errorf("notices = %q", messages)
+	}
+}
+
+func TestParseSendTime(t *testing.T) {
+	now := time.Date(2022, 5, 10, 21, 30, 0, 0, time.Local)
+	tests := []struct {
+		args    string
+		want    time.Time
+		wantErr string
+	}{
+		{"at 08:00", time.Date(2022, 5, 11, 8, 0, 0, 0, time.Local), ""},
+		{"at 8am", time.Date(2022, 5, 11, 8, 0, 0, 0, time.Local), ""},
+		{"at 10:15PM", time.Date(2022, 5, 10, 22, 15, 0, 0, time.Local), ""},
+		{"at 2022-05-12 09:00", time.Date(2022, 5, 12, 9, 0, 0, 0, time.Local), ""},
+		{"at 2022-05-10 09:00", time.Time{}, "in the past"},
+		{"at 25:00", time.Time{}, "invalid time"},
+		{"in 30m", now.Add(30 * time.Minute), ""},
+		{"in 2h30m", now.Add(150 * time.Minute), ""},
+		{"in 1d", now.Add(24 * time.Hour), ""},
+		{"in -5m", time.Time{}, "invalid duration"},
+		{"in 0d", time.Time{}, "invalid duration"},
+		{"in soon", time.Time{}, "invalid duration"},
+		{"tomorrow", time.Time{}, "usage"},
+		{"", time.Time{}, "usage"},
+	}
+	for _, test := range tests {
+		got, err := parseSendTime(test.args, now)
+		if len(test.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parseSendTime(%q) error = %v, want %q", test.args, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSendTime(%q) error = %v", test.args, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("parseSendTime(%q) = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestUnscheduleInPortal(t *testing.T) {
+	setupTestPortals(t)
+	setupTestMatrix(t, http.NewServeMux())
+	_, err := insertOutboxMail(testRoom.String(), "me@example.org", "you@example.org", "Hello", []byte("Hello"), outboxScheduled, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unschedule(&event.Event{RoomID: "!a:example.org"}, "1")
+	if mails, _ := getOutboxMails(testRoom.String()); len(mails) != 0 {
+		t.Errorf("scheduled email of the bridged room wasn't deleted from its portal: %+v", mails)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//controlRoomID returns the bridged room a portal belongs to or the room itself if it isn't a portal
+func controlRoomID(roomID string) string {
+	portal, err := getPortalByRoomID(roomID)
+	if err != nil {
+		WriteLog(logError, "#129 getPortalByRoomID: "+err.Error())
+		return roomID
+	}
+	if portal != nil {
+		return portal.controlRoomID
+	}
+	return roomID
+}
+
+//portalForMail returns the portal an email has to be posted into and creates it if it doesn't exist yet.
+//nil means the email gets posted into the bridged room itself
+func portalForMail(account imapAccountount, content *email, messageIDs []string, normalizedSubject string) *portal {
+	if len(content.sendermails) == 0 {
+		return nil
+	}
+	mode, err := getPortalMode(account.roomID)
+	if err != nil {
+		WriteLog(logError, "#124 getPortalMode: "+err.Error())
+		return nil
+	}
+	address := strings.ToLower(content.sendermails[0])
+
+	var existing *portal
+	switch mode {
+	case portalModeCorrespondent:
+		existing, err = findCorrespondentPortal(account.roomPKID, address)
+	case portalModeConversation:
+		existing, err = findConversationPortal(account.roomPKID, messageIDs, normalizedSubject, address)
+	default:
+		return nil
+	}
+	if err != nil {
+		WriteLog(logError, "#125 finding portal: "+err.Error())
+		return nil
+	}
+	if existing != nil {
+		return existing
+	}
+
+	name := content.senderName
+	if len(name) == 0 {
+		name = address
+	}
+	topic := "Emails from " + address
+	if mode == portalModeConversation {
+		topic = name + ": " + content.subject
+		name = content.subject
+		if len(strings.TrimSpace(name)) == 0 {
+			name = "(no subject)"
+		}
+	}
+	portalRoomID, err := createPortalRoom(id.RoomID(account.roomID), name, topic)
+	if err != nil {
+		WriteLog(logError, "#126 creating portal room: "+err.Error())
+		sendNotice(id.RoomID(account.roomID), "Couldn't create a room for "+name+": "+err.Error())
+		return nil
+	}
+	pk, err := insertPortal(account.roomPKID, portalRoomID.String(), mode, address)
+	if err != nil {
+		WriteLog(logError, "#127 insertPortal: "+err.Error())
+		return nil
+	}
+	sendNotice(id.RoomID(account.roomID), "Created a new room for "+name)
+	return &portal{int(pk), account.roomPKID, portalRoomID.String(), account.roomID, mode, address}
+}
+
+//createPortalRoom creates a room and invites everyone from the bridged room into it
+func createPortalRoom(controlRoom id.RoomID, name, topic string) (id.RoomID, error) {
+	members, err := matrixClient.JoinedMembers(controlRoom)
+	if err != nil {
+		return "", err
+	}
+	var invite []id.UserID
+	for userID := range members.Joined {
+		if userID != matrixClient.UserID && !isPuppet(userID) {
+			invite = append(invite, userID)
+		}
+	}
+
+	request := &mautrix.ReqCreateRoom{
+		Preset: "private_chat",
+		Name:   name,
+		Topic:  topic,
+		Invite: invite,
+	}
+	//portals of encrypted rooms get encrypted too
+	if encryption := store.GetEncryptionEvent(controlRoom); encryption != nil {
+		stateKey := ""
+		request.InitialState = []*event.Event{{
+			Type:     event.StateEncryption,
+			StateKey: &stateKey,
+			Content:  event.Content{Parsed: encryption},
+		}}
+	}
+	resp, err := matrixClient.CreateRoom(request)
+	if err != nil {
+		return "", err
+	}
+	return resp.RoomID, nil
+}
+
+//leavePortals leaves all portal rooms of a bridged room
+func leavePortals(roomID string) {
+	portalRoomIDs, err := getPortalRoomIDs(roomID)
+	if err != nil {
+		WriteLog(logError, "#128 getPortalRoomIDs: "+err.Error())
+		return
+	}
+	for _, portalRoomID := range portalRoomIDs {
+		matrixClient.LeaveRoom(id.RoomID(portalRoomID))
+	}
+}
+
+//replyInPortal sends a message written in a portal room to its correspondent
+func replyInPortal(evt *event.Event, message string, portal *portal) {
+	mail, err := getLatestMailInPortal(portal.pk)
+	if err != nil {
+		WriteLog(critical, "#130 getLatestMailInPortal: "+err.Error())
+		sendText(evt.RoomID, "An server-error occured Errorcode: #130")
+		return
+	}
+	if mail == nil {
+		sendText(evt.RoomID, "There is no email in this room to reply to")
+		return
+	}
+	replyToMail(evt, message, mail)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"html/template"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+//password placeholder in !setup which requests the password form
+const askPassword = "?"
+
+//how long a password form link can be used
+const setupFormLifetime = 10 * time.Minute
+
+//pendingSetup is a !setup waiting for its password to be entered in the form
+type pendingSetup struct {
+	evt   *event.Event
+	parts []string
+}
+
+var pendingSetups = make(map[string]*pendingSetup)
+var setupFormMutex sync.Mutex
+var setupFormServer *http.Server
+
+var setupFormTemplate = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Matrix-EmailBridge</title></head>
+<body>
+{{if .Done}}<p>{{.Done}}</p>{{else}}
+<h3>Password for {{.Username}} ({{.Host}})</h3>
+<form method="POST">
+<input type="password" name="password" autocomplete="current-password" autofocus required>
+<button type="submit">Save</button>
+</form>{{end}}
+</body>
+</html>`))
+
+//redactCredentials removes a message containing credentials from the room
+func redactCredentials(evt *event.Event) {
+	_, err := matrixClient.RedactEvent(evt.RoomID, evt.ID, mautrix.ReqRedact{Reason: "contains credentials"})
+	if err != nil {
+		WriteLog(logError, "#113 redacting credentials: "+err.Error())
+		sendText(evt.RoomID, "I couldn't remove your message containing your password. Please delete it yourself or give me the permission to remove messages")
+	}
+}
+
+//requestPasswordForm sends a one-time link to a form where the password of the !setup can be entered
+func requestPasswordForm(evt *event.Event, parts []string) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		WriteLog(critical, "#114 generating setup token: "+err.Error())
+		sendText(evt.RoomID, "An server-error occured Errorcode: #114")
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	setupFormMutex.Lock()
+	if setupFormServer == nil {
+		if err := startSetupFormServer(); err != nil {
+			setupFormMutex.Unlock()
+			WriteLog(critical, "#115 starting setup form: "+err.Error())
+			sendText(evt.RoomID, "An server-error occured Errorcode: #115")
+			return
+		}
+	}
+	pendingSetups[token] = &pendingSetup{evt, parts}
+	setupFormMutex.Unlock()
+
+	time.AfterFunc(setupFormLifetime, func() {
+		setupFormMutex.Lock()
+		defer setupFormMutex.Unlock()
+		delete(pendingSetups, token)
+		stopSetupFormServerIfUnused()
+	})
+
+	formURL := strings.TrimSuffix(viper.GetString("setupFormURL"), "/") + "/setup/" + token
+	sendText(evt.RoomID, "Open "+formURL+" to enter your password. The link works only once and expires in "+setupFormLifetime.String())
+}
+
+//startSetupFormServer starts the https server of the password form. setupFormMutex has to be locked
+func startSetupFormServer() error {
+	var cert tls.Certificate
+	var err error
+	certFile, keyFile := viper.GetString("setupFormCert"), viper.GetString("setupFormKey")
+	if len(certFile) > 0 && len(keyFile) > 0 {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = generateSelfSignedCert()
+	}
+	if err != nil {
+		return err
+	}
+
+	listener, err := tls.Listen("tcp", viper.GetString("setupFormListen"), &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/setup/", handleSetupForm)
+	server := &http.Server{Handler: mux, ReadTimeout: 30 * time.Second, WriteTimeout: 30 * time.Second}
+	setupFormServer = server
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			WriteLog(logError, "#116 setup form server: "+err.Error())
+		}
+	}()
+	return nil
+}
+
+//stopSetupFormServerIfUnused stops the form server if no setup is pending. setupFormMutex has to be locked
+func stopSetupFormServerIfUnused() {
+	if len(pendingSetups) == 0 && setupFormServer != nil {
+		server := setupFormServer
+		setupFormServer = nil
+		//shutdown waits for running requests, so the form can still send its response
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		}()
+	}
+}
+
+func handleSetupForm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'")
+
+	token := strings.TrimPrefix(r.URL.Path, "/setup/")
+	setupFormMutex.Lock()
+	pending, ok := pendingSetups[token]
+	if ok && r.Method == http.MethodPost {
+		delete(pendingSetups, token)
+	}
+	setupFormMutex.Unlock()
+	if !ok {
+		http.Error(w, "This link is invalid or expired", http.StatusNotFound)
+		return
+	}
+
+	data := struct{ Username, Host, Done string }{strings.TrimSpace(pending.parts[2]), strings.TrimSpace(pending.parts[1]), ""}
+	if r.Method == http.MethodPost {
+		password := r.PostFormValue("password")
+		if len(password) == 0 {
+			//the link was used, a new one has to be requested
+			data.Done = "No password entered. Send the !setup command again to get a new link."
+		} else {
+			parts := append([]string{}, pending.parts...)
+			parts[3] = password
+			go setupAccount(pending.evt, parts)
+			data.Done = "Password received. You can close this page and go back to Matrix."
+		}
+		setupFormMutex.Lock()
+		stopSetupFormServerIfUnused()
+		setupFormMutex.Unlock()
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	setupFormTemplate.Execute(w, data)
+}
+
+//generateSelfSignedCert creates a certificate for the host of the setupFormURL
+func generateSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	host := "localhost"
+	if formURL, err := url.Parse(viper.GetString("setupFormURL")); err == nil && len(formURL.Hostname()) > 0 {
+		host = formURL.Hostname()
+	}
+	certTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		certTemplate.IPAddresses = []net.IP{ip}
+	} else {
+		certTemplate.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -2,7 +2,12 @@
 echo "Be sure you have installed go >= 1.12 if not, press Ctrl+c"
 sleep 4
 go get
-go build
+if pkg-config --exists olm 2>/dev/null; then
+	go build -tags e2ee
+else
+	echo "libolm not found (e.g. libolm-dev), building without support for encrypted rooms"
+	go build
+fi
 ./main
 chmod 600 cfg.json data.db
 mkdir ./temp